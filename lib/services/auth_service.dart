@@ -122,6 +122,9 @@ class AuthService {
 
   User? _currentUser;
   String? _deviceId;
+  // Laufender Refresh; parallele 401er warten darauf, statt den bereits
+  // ersetzten Refresh Token erneut zu senden
+  Future<String?>? _pendingRefresh;
 
   AuthService({ApiClient? api, PlatformStorage? storage})
       : _api = api ?? ApiClient(),
@@ -331,7 +334,11 @@ class AuthService {
   }
 
   /// Token refresh
-  Future<String?> _refreshToken() async {
+  Future<String?> _refreshToken() {
+    return _pendingRefresh ??= _doRefreshToken().whenComplete(() => _pendingRefresh = null);
+  }
+
+  Future<String?> _doRefreshToken() async {
     final refreshToken = _api.refreshToken;
     if (refreshToken == null) return null;
 
@@ -341,10 +348,14 @@ class AuthService {
       });
 
       final newAccessToken = response['access_token'] as String;
+      // Der Server ersetzt den Refresh Token bei jedem Refresh, der alte ist
+      // danach ungültig
+      final newRefreshToken = response['refresh_token'] as String? ?? refreshToken;
 
-      // Neuen Token speichern
+      // Neue Tokens speichern
       await _storage.write(key: _keyAccessToken, value: newAccessToken);
-      _api.setTokens(accessToken: newAccessToken, refreshToken: refreshToken);
+      await _storage.write(key: _keyRefreshToken, value: newRefreshToken);
+      _api.setTokens(accessToken: newAccessToken, refreshToken: newRefreshToken);
 
       debugPrint('Token refreshed successfully');
       return newAccessToken;
@@ -75,6 +75,7 @@ class CloudSyncService {
 
   // Prefs Keys
   static const _keyLastSync = 'sync_last_timestamp';
+  static const _keyPullCursor = 'sync_pull_cursor';
   static const _keySyncQueue = 'sync_queue';
 
   // Data Types für Server
@@ -211,34 +212,54 @@ class CloudSyncService {
     return count;
   }
 
-  /// Pull Änderungen vom Server
+  /// Pull Änderungen vom Server, seitenweise ab dem gespeicherten Cursor
   Future<int> _pullChanges() async {
     final deviceId = _auth.deviceId;
     if (deviceId == null) throw Exception('No device ID');
 
     final prefs = await SharedPreferences.getInstance();
-    final lastSync = prefs.getInt(_keyLastSync) ?? 0;
-
-    final response = await _auth.api.get('/api/v1/sync/pull', queryParams: {
-      'device_id': deviceId,
-      'since': lastSync.toString(),
-    });
-
-    final items = (response['items'] as List?) ?? [];
-    final serverTimestamp = response['timestamp'] as int;
+    var cursor = prefs.getString(_keyPullCursor) ?? '';
 
     var count = 0;
-    for (final item in items) {
+    var hasMore = true;
+    int? serverTimestamp;
+    while (hasMore) {
+      final Map<String, dynamic> response;
       try {
-        await _processIncomingItem(item as Map<String, dynamic>);
-        count++;
-      } catch (e) {
-        debugPrint('Failed to process item: $e');
+        response = await _auth.api.get('/api/v1/sync/pull', queryParams: {
+          'device_id': deviceId,
+          'cursor': cursor,
+        });
+      } on ApiException catch (e) {
+        // Gelöschte Einträge nach dem Cursor wurden bereinigt: von vorne beginnen
+        if (e.code == 'RESYNC_REQUIRED' && cursor.isNotEmpty) {
+          cursor = '';
+          await prefs.remove(_keyPullCursor);
+          continue;
+        }
+        rethrow;
       }
+
+      final items = (response['items'] as List?) ?? [];
+      for (final item in items) {
+        try {
+          await _processIncomingItem(item as Map<String, dynamic>);
+          count++;
+        } catch (e) {
+          debugPrint('Failed to process item: $e');
+        }
+      }
+
+      // Cursor nach jeder Seite speichern, damit ein Abbruch dort weitermacht
+      cursor = response['next_cursor'] as String? ?? cursor;
+      await prefs.setString(_keyPullCursor, cursor);
+      hasMore = response['has_more'] as bool? ?? false;
+      serverTimestamp = response['timestamp'] as int?;
     }
 
-    // Timestamp speichern
-    await prefs.setInt(_keyLastSync, serverTimestamp);
+    if (serverTimestamp != null) {
+      await prefs.setInt(_keyLastSync, serverTimestamp);
+    }
 
     debugPrint('Pulled $count items from server');
     return count;
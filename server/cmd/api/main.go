@@ -11,8 +11,11 @@ import (
 	"github.com/sprobst76/vibedtracker-server/internal/config"
 	"github.com/sprobst76/vibedtracker-server/internal/database"
 	"github.com/sprobst76/vibedtracker-server/internal/handlers"
+	"github.com/sprobst76/vibedtracker-server/internal/mail"
 	"github.com/sprobst76/vibedtracker-server/internal/middleware"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
 	"github.com/sprobst76/vibedtracker-server/internal/repository"
+	"github.com/sprobst76/vibedtracker-server/internal/storage"
 )
 
 func main() {
@@ -33,22 +36,67 @@ func main() {
 	defer db.Close()
 	log.Println("Connected to database")
 
+	// Blob store for encrypted attachments
+	blobStore, err := storage.NewLocalStore(cfg.BlobStoreDir)
+	if err != nil {
+		log.Fatalf("Failed to open blob store: %v", err)
+	}
+
 	// Create repositories
 	userRepo := repository.NewUserRepository(db.Pool)
 	tokenRepo := repository.NewTokenRepository(db.Pool)
 	deviceRepo := repository.NewDeviceRepository(db.Pool)
-	syncRepo := repository.NewSyncRepository(db.Pool)
+	syncRepo := repository.NewSyncRepository(db.Pool, models.StorageLimits{
+		MaxItemBytes: cfg.MaxItemBytes,
+		UserBytes:    cfg.UserQuotaBytes,
+		UserItems:    cfg.UserQuotaItems,
+	})
 	totpRepo := repository.NewTOTPRepository(db.Pool)
 	passphraseRecoveryRepo := repository.NewPassphraseRecoveryRepository(db.Pool)
+	syncEvents := repository.NewSyncEvents(db.Pool)
+	activeSessionRepo := repository.NewActiveSessionRepository(db.Pool)
+	idempotencyRepo := repository.NewIdempotencyRepository(db.Pool)
+	attachmentRepo := repository.NewAttachmentRepository(db.Pool, blobStore, syncRepo)
+	verificationRepo := repository.NewEmailVerificationRepository(db.Pool)
+	passwordResetRepo := repository.NewPasswordResetRepository(db.Pool)
+
+	// Create mailer. Links in mails are never built from request headers,
+	// a forged Host would send reset links to another site.
+	var mailer mail.Mailer
+	switch cfg.MailBackend {
+	case "smtp":
+		if cfg.PublicURL == "" {
+			log.Fatalf("PUBLIC_URL is required with MAIL_BACKEND=smtp")
+		}
+		mailer, err = mail.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+		if err != nil {
+			log.Fatalf("Invalid MAIL_FROM %q: %v", cfg.MailFrom, err)
+		}
+	case "log":
+		if cfg.PublicURL == "" {
+			cfg.PublicURL = "http://localhost:" + cfg.Port
+			log.Printf("Warning: PUBLIC_URL not set, links in mails point to %s", cfg.PublicURL)
+		}
+		mailer, err = mail.NewLogMailer(cfg.MailDir, cfg.MailFrom)
+		if err != nil {
+			log.Fatalf("Failed to create mail directory: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown MAIL_BACKEND %q (expected smtp or log)", cfg.MailBackend)
+	}
 
 	// Create handlers
-	authHandler := handlers.NewAuthHandler(cfg, userRepo, tokenRepo, deviceRepo, totpRepo)
-	syncHandler := handlers.NewSyncHandler(syncRepo, deviceRepo)
-	deviceHandler := handlers.NewDeviceHandler(deviceRepo, tokenRepo)
-	adminHandler := handlers.NewAdminHandler(userRepo, tokenRepo)
+	authHandler := handlers.NewAuthHandler(cfg, userRepo, tokenRepo, deviceRepo, totpRepo, verificationRepo, passwordResetRepo, mailer)
+	syncHandler := handlers.NewSyncHandler(cfg, syncRepo, deviceRepo, syncEvents, idempotencyRepo)
+	deviceHandler := handlers.NewDeviceHandler(cfg, deviceRepo, tokenRepo)
+	sessionHandler := handlers.NewSessionHandler(tokenRepo)
+	adminHandler := handlers.NewAdminHandler(cfg, userRepo, tokenRepo, syncRepo)
 	totpHandler := handlers.NewTOTPHandler(cfg, userRepo, totpRepo, tokenRepo, deviceRepo)
-	webHandler := handlers.NewWebHandler(cfg, userRepo, tokenRepo, totpRepo, syncRepo, deviceRepo, passphraseRecoveryRepo)
+	webHandler := handlers.NewWebHandler(cfg, userRepo, tokenRepo, totpRepo, syncRepo, deviceRepo, passphraseRecoveryRepo, syncEvents, activeSessionRepo, verificationRepo, passwordResetRepo, mailer)
 	passphraseHandler := handlers.NewPassphraseHandler(userRepo, passphraseRecoveryRepo)
+	timerHandler := handlers.NewTimerHandler(activeSessionRepo, deviceRepo)
+	keyRotationHandler := handlers.NewKeyRotationHandler(syncRepo, deviceRepo)
+	attachmentHandler := handlers.NewAttachmentHandler(cfg, attachmentRepo, syncRepo)
 
 	// Create initial admin if configured
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -57,6 +105,9 @@ func main() {
 	}
 	cancel()
 
+	// Listen for sync changes from all API instances
+	go syncEvents.Run(context.Background())
+
 	// Cleanup expired tokens and attempts periodically
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour)
@@ -65,12 +116,30 @@ func main() {
 			if err := tokenRepo.CleanupExpired(ctx); err != nil {
 				log.Printf("Failed to cleanup expired tokens: %v", err)
 			}
+			if err := verificationRepo.CleanupExpired(ctx); err != nil {
+				log.Printf("Failed to cleanup expired email verifications: %v", err)
+			}
+			if err := passwordResetRepo.CleanupExpired(ctx); err != nil {
+				log.Printf("Failed to cleanup expired password resets: %v", err)
+			}
 			if err := totpRepo.CleanupOldAttempts(ctx); err != nil {
 				log.Printf("Failed to cleanup old TOTP attempts: %v", err)
 			}
 			if err := passphraseRecoveryRepo.CleanupOldAttempts(ctx); err != nil {
 				log.Printf("Failed to cleanup old passphrase recovery attempts: %v", err)
 			}
+			if err := syncRepo.CleanupRevisions(ctx, time.Now().Add(-cfg.RevisionRetention)); err != nil {
+				log.Printf("Failed to cleanup old revisions: %v", err)
+			}
+			if _, err := syncRepo.PurgeTombstones(ctx, time.Now().Add(-cfg.TombstoneRetention)); err != nil {
+				log.Printf("Failed to purge deleted sync items: %v", err)
+			}
+			if err := idempotencyRepo.CleanupExpired(ctx, time.Now().Add(-cfg.IdempotencyRetention)); err != nil {
+				log.Printf("Failed to cleanup idempotency keys: %v", err)
+			}
+			if err := attachmentRepo.Cleanup(ctx, time.Now().Add(-cfg.AttachmentUploadExpiry)); err != nil {
+				log.Printf("Failed to cleanup attachments: %v", err)
+			}
 			totpRepo.CleanupExpiredTempTokens()
 			cancel()
 		}
@@ -82,8 +151,9 @@ func main() {
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, Content-Encoding, Accept-Encoding")
+		c.Header("Access-Control-Expose-Headers", "Idempotent-Replayed")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -108,6 +178,10 @@ func main() {
 			auth.POST("/register", authHandler.Register)
 			auth.POST("/login", authHandler.Login)
 			auth.POST("/refresh", authHandler.Refresh)
+			auth.POST("/verify-email", authHandler.VerifyEmail)
+			auth.POST("/resend-verification", authHandler.ResendVerification)
+			auth.POST("/forgot-password", authHandler.ForgotPassword)
+			auth.POST("/reset-password", authHandler.ResetPassword)
 			// TOTP validation during login (public, uses temp token)
 			auth.POST("/totp/validate", totpHandler.Validate)
 			auth.POST("/recovery/validate", totpHandler.ValidateRecovery)
@@ -119,8 +193,19 @@ func main() {
 		{
 			// User profile
 			protected.GET("/me", authHandler.Me)
+			protected.POST("/me/password", authHandler.ChangePassword)
 			protected.POST("/key", passphraseHandler.SetKey)
 
+			// Passphrase change with re-encryption of all items
+			rotation := protected.Group("/key/rotation")
+			{
+				rotation.GET("", keyRotationHandler.Get)
+				rotation.POST("/start", keyRotationHandler.Start)
+				rotation.POST("/items", keyRotationHandler.Items)
+				rotation.POST("/commit", keyRotationHandler.Commit)
+				rotation.POST("/abort", keyRotationHandler.Abort)
+			}
+
 			// Passphrase recovery management
 			passphrase := protected.Group("/passphrase")
 			{
@@ -143,8 +228,38 @@ func main() {
 			sync := protected.Group("/sync")
 			{
 				sync.GET("/pull", syncHandler.Pull)
+				sync.GET("/snapshot", syncHandler.Snapshot)
 				sync.POST("/push", syncHandler.Push)
 				sync.GET("/status", syncHandler.Status)
+				sync.GET("/data-types", syncHandler.DataTypes)
+				sync.GET("/events", syncHandler.Events)
+				sync.GET("/revisions", syncHandler.ListRevisions)
+				sync.POST("/revisions/:id/restore", syncHandler.RestoreRevision)
+				sync.POST("/restore", syncHandler.RestoreAccount)
+				sync.POST("/purge", syncHandler.Purge)
+				sync.GET("/export", syncHandler.Export)
+				sync.POST("/import", syncHandler.Import)
+				sync.GET("/log", syncHandler.Log)
+				sync.GET("/log/daily", syncHandler.LogDaily)
+			}
+
+			// Encrypted attachments (require approval)
+			attachments := protected.Group("/attachments")
+			{
+				attachments.POST("/uploads", attachmentHandler.CreateUpload)
+				attachments.GET("/uploads/:id", attachmentHandler.GetUpload)
+				attachments.PATCH("/uploads/:id", attachmentHandler.UploadChunk)
+				attachments.DELETE("/uploads/:id", attachmentHandler.CancelUpload)
+				attachments.GET("/:hash", attachmentHandler.Download)
+				attachments.HEAD("/:hash", attachmentHandler.Download)
+			}
+
+			// Running timer, shared across devices
+			timer := protected.Group("/timer")
+			{
+				timer.GET("", timerHandler.Get)
+				timer.POST("/start", timerHandler.Start)
+				timer.POST("/stop", timerHandler.Stop)
 			}
 
 			// Device routes
@@ -153,6 +268,15 @@ func main() {
 				devices.GET("", deviceHandler.List)
 				devices.POST("", deviceHandler.Register)
 				devices.DELETE("/:id", deviceHandler.Delete)
+				devices.PUT("/:id/capabilities", deviceHandler.UpdateCapabilities)
+			}
+
+			// Logins of the user
+			sessions := protected.Group("/sessions")
+			{
+				sessions.GET("", sessionHandler.List)
+				sessions.DELETE("/:id", sessionHandler.Revoke)
+				sessions.POST("/revoke-others", sessionHandler.RevokeOthers)
 			}
 		}
 
@@ -165,6 +289,7 @@ func main() {
 			admin.POST("/users/:id/approve", adminHandler.ApproveUser)
 			admin.POST("/users/:id/block", adminHandler.BlockUser)
 			admin.POST("/users/:id/unblock", adminHandler.UnblockUser)
+			admin.PUT("/users/:id/quota", adminHandler.SetUserQuota)
 			admin.DELETE("/users/:id", adminHandler.DeleteUser)
 			admin.GET("/stats", adminHandler.Stats)
 		}
@@ -181,6 +306,11 @@ func main() {
 	{
 		// Public routes
 		web.GET("/login", webHandler.LoginPage)
+		web.GET("/verify-email", webHandler.VerifyEmail)
+		web.GET("/forgot-password", webHandler.ForgotPasswordPage)
+		web.POST("/auth/forgot-password", webHandler.ForgotPassword)
+		web.GET("/reset-password", webHandler.ResetPasswordPage)
+		web.POST("/auth/reset-password", webHandler.ResetPassword)
 		web.POST("/auth/login", webHandler.Login)
 		web.POST("/auth/totp", webHandler.TOTPVerify)
 
@@ -193,6 +323,16 @@ func main() {
 			webProtected.GET("/vacation", webHandler.Vacation)
 			webProtected.GET("/settings", webHandler.Settings)
 			webProtected.GET("/api/data", webHandler.GetEncryptedData)
+			webProtected.GET("/api/events", webHandler.SyncEvents)
+			webProtected.GET("/api/sync-log", webHandler.SyncLog)
+			webProtected.GET("/api/sessions", webHandler.Sessions)
+			webProtected.DELETE("/api/sessions/:id", webHandler.RevokeSession)
+			webProtected.POST("/api/sessions/revoke-others", webHandler.RevokeOtherSessions)
+			webProtected.GET("/api/password", webHandler.PasswordForm)
+			webProtected.POST("/api/password", webHandler.ChangePassword)
+			webProtected.GET("/api/timer", webHandler.GetTimer)
+			webProtected.POST("/api/timer/start", webHandler.StartTimer)
+			webProtected.POST("/api/timer/stop", webHandler.StopTimer)
 			webProtected.POST("/api/entry", webHandler.SaveEncryptedEntry)
 			webProtected.DELETE("/api/entry/:id", webHandler.DeleteEncryptedEntry)
 			webProtected.POST("/api/vacation", webHandler.SaveVacation)
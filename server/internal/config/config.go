@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,6 +16,28 @@ type Config struct {
 	AdminEmail      string
 	AdminPassword   string
 	AllowRegistration bool
+	RevisionRetention time.Duration
+	TombstoneRetention time.Duration
+	IdempotencyRetention time.Duration
+	MaxItemBytes    int
+	UserQuotaBytes  int64
+	UserQuotaItems  int
+	MaxImportBytes  int64
+	MinAppVersion   string
+	MinSchemaVersions map[string]int
+	BlobStoreDir    string
+	MaxAttachmentBytes int64
+	AttachmentUploadExpiry time.Duration
+	StaleDeviceAfter time.Duration
+	PublicURL       string
+	MailBackend     string
+	MailDir         string
+	MailFrom        string
+	SMTPHost        string
+	SMTPPort        int
+	SMTPUsername    string
+	SMTPPassword    string
+	RequireEmailVerification bool
 }
 
 func Load() *Config {
@@ -26,6 +50,28 @@ func Load() *Config {
 		AdminEmail:      getEnv("ADMIN_EMAIL", ""),
 		AdminPassword:   getEnv("ADMIN_PASSWORD", ""),
 		AllowRegistration: getEnv("ALLOW_REGISTRATION", "true") == "true",
+		RevisionRetention: time.Duration(getEnvInt("REVISION_RETENTION_DAYS", 30)) * 24 * time.Hour,
+		TombstoneRetention: time.Duration(getEnvInt("TOMBSTONE_RETENTION_DAYS", 90)) * 24 * time.Hour,
+		IdempotencyRetention: time.Duration(getEnvInt("IDEMPOTENCY_RETENTION_HOURS", 24)) * time.Hour,
+		MaxItemBytes:    getEnvInt("MAX_ITEM_BYTES", 1<<20),
+		UserQuotaBytes:  int64(getEnvInt("USER_QUOTA_BYTES", 100<<20)),
+		UserQuotaItems:  getEnvInt("USER_QUOTA_ITEMS", 100000),
+		MaxImportBytes:  int64(getEnvInt("MAX_IMPORT_BYTES", 256<<20)),
+		MinAppVersion:   getEnv("MIN_APP_VERSION", ""),
+		MinSchemaVersions: getEnvIntMap("MIN_SCHEMA_VERSIONS"),
+		BlobStoreDir:    getEnv("BLOB_STORE_DIR", "./data/blobs"),
+		MaxAttachmentBytes: int64(getEnvInt("MAX_ATTACHMENT_BYTES", 25<<20)),
+		AttachmentUploadExpiry: time.Duration(getEnvInt("ATTACHMENT_UPLOAD_EXPIRY_HOURS", 24)) * time.Hour,
+		StaleDeviceAfter: time.Duration(getEnvInt("STALE_DEVICE_DAYS", 7)) * 24 * time.Hour,
+		PublicURL:       strings.TrimSuffix(getEnv("PUBLIC_URL", ""), "/"),
+		MailBackend:     getEnv("MAIL_BACKEND", "log"),
+		MailDir:         getEnv("MAIL_DIR", ""),
+		MailFrom:        getEnv("MAIL_FROM", "VibedTracker <noreply@localhost>"),
+		SMTPHost:        getEnv("SMTP_HOST", ""),
+		SMTPPort:        getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:    getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:    getEnv("SMTP_PASSWORD", ""),
+		RequireEmailVerification: getEnv("REQUIRE_EMAIL_VERIFICATION", "false") == "true",
 	}
 }
 
@@ -35,3 +81,25 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// getEnvIntMap parses "key=1,other=2" into a map; invalid entries are skipped
+func getEnvIntMap(key string) map[string]int {
+	result := map[string]int{}
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			result[strings.TrimSpace(name)] = n
+		}
+	}
+	return result
+}
@@ -7,19 +7,24 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"github.com/sprobst76/vibedtracker-server/internal/config"
 	"github.com/sprobst76/vibedtracker-server/internal/models"
 	"github.com/sprobst76/vibedtracker-server/internal/repository"
 )
 
 type AdminHandler struct {
+	cfg    *config.Config
 	users  *repository.UserRepository
 	tokens *repository.TokenRepository
+	sync   *repository.SyncRepository
 }
 
-func NewAdminHandler(users *repository.UserRepository, tokens *repository.TokenRepository) *AdminHandler {
+func NewAdminHandler(cfg *config.Config, users *repository.UserRepository, tokens *repository.TokenRepository, sync *repository.SyncRepository) *AdminHandler {
 	return &AdminHandler{
+		cfg:    cfg,
 		users:  users,
 		tokens: tokens,
+		sync:   sync,
 	}
 }
 
@@ -67,6 +72,22 @@ func (h *AdminHandler) ApproveUser(c *gin.Context) {
 		return
 	}
 
+	if h.cfg.RequireEmailVerification {
+		user, err := h.users.GetByID(c.Request.Context(), userID)
+		if err != nil {
+			if errors.Is(err, repository.ErrUserNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to approve user"})
+			return
+		}
+		if !user.EmailVerified {
+			c.JSON(http.StatusConflict, gin.H{"error": "email address not verified", "code": "EMAIL_NOT_VERIFIED"})
+			return
+		}
+	}
+
 	if err := h.users.Approve(c.Request.Context(), userID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to approve user"})
 		return
@@ -126,6 +147,38 @@ func (h *AdminHandler) DeleteUser(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
 }
 
+// SetUserQuota overrides the storage quota of a user
+func (h *AdminHandler) SetUserQuota(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var req models.SetQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.users.SetQuota(c.Request.Context(), userID, req.QuotaBytes, req.QuotaItems); err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set quota"})
+		return
+	}
+
+	usage, err := h.sync.GetStorageUsage(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get storage usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "quota updated", "storage": usage})
+}
+
 func (h *AdminHandler) Stats(c *gin.Context) {
 	stats, err := h.users.GetStats(c.Request.Context())
 	if err != nil {
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/sprobst76/vibedtracker-server/internal/config"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+	"github.com/sprobst76/vibedtracker-server/internal/repository"
+)
+
+// maxAttachmentChunkBytes limits a single upload request; larger files are
+// sent in several chunks
+const maxAttachmentChunkBytes = 8 << 20
+
+// AttachmentHandler stores client-encrypted files (receipts, timesheets).
+// Files are uploaded in resumable chunks, addressed by the SHA-256 of their
+// encrypted content and referenced from items via SyncPushItem.Attachments.
+type AttachmentHandler struct {
+	cfg         *config.Config
+	attachments *repository.AttachmentRepository
+	sync        *repository.SyncRepository
+}
+
+func NewAttachmentHandler(cfg *config.Config, attachments *repository.AttachmentRepository, sync *repository.SyncRepository) *AttachmentHandler {
+	return &AttachmentHandler{
+		cfg:         cfg,
+		attachments: attachments,
+		sync:        sync,
+	}
+}
+
+// CreateUpload starts a chunked upload. If the user already stored a file with
+// the same hash, no upload is needed and the existing attachment is returned.
+func (h *AttachmentHandler) CreateUpload(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreateAttachmentUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Hash = strings.ToLower(req.Hash)
+
+	if h.cfg.MaxAttachmentBytes > 0 && req.Size > h.cfg.MaxAttachmentBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "attachment exceeds maximum size", "code": "ATTACHMENT_TOO_LARGE", "max_attachment_bytes": h.cfg.MaxAttachmentBytes})
+		return
+	}
+
+	existing, err := h.attachments.Get(c.Request.Context(), userID, req.Hash)
+	if err == nil {
+		c.JSON(http.StatusOK, gin.H{"exists": true, "attachment": existing})
+		return
+	}
+	if !errors.Is(err, repository.ErrAttachmentNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create upload"})
+		return
+	}
+
+	upload, err := h.attachments.CreateUpload(c.Request.Context(), userID, req.Hash, req.Size)
+	if errors.Is(err, repository.ErrInvalidAttachmentHash) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "INVALID_HASH"})
+		return
+	}
+	if errors.Is(err, repository.ErrQuotaExceeded) {
+		usage, _ := h.sync.GetStorageUsage(c.Request.Context(), userID)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "storage quota exceeded", "code": "QUOTA_EXCEEDED", "storage": usage})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create upload"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"exists": false, "upload": upload, "max_chunk_bytes": maxAttachmentChunkBytes})
+}
+
+// GetUpload returns the offset to resume an interrupted upload at
+func (h *AttachmentHandler) GetUpload(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+	uploadID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+
+	upload, err := h.attachments.GetUpload(c.Request.Context(), userID, uploadID)
+	if errors.Is(err, repository.ErrUploadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found", "code": "UPLOAD_NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get upload"})
+		return
+	}
+
+	c.JSON(http.StatusOK, upload)
+}
+
+// UploadChunk appends the raw request body at ?offset=. The last chunk
+// completes the upload once its content matches the announced hash.
+func (h *AttachmentHandler) UploadChunk(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+	uploadID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+
+	var req models.UploadChunkRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentChunkBytes)
+	upload, err := h.attachments.WriteChunk(c.Request.Context(), userID, uploadID, *req.Offset, body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, repository.ErrUploadNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload not found", "code": "UPLOAD_NOT_FOUND"})
+		case errors.Is(err, repository.ErrUploadOffsetMismatch):
+			// Tell the client where to continue
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "OFFSET_MISMATCH", "offset": upload.Offset})
+		case errors.As(err, &maxBytesErr):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "chunk too large", "code": "CHUNK_TOO_LARGE", "max_chunk_bytes": maxAttachmentChunkBytes})
+		case errors.Is(err, repository.ErrUploadTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "code": "UPLOAD_TOO_LARGE"})
+		case errors.Is(err, repository.ErrAttachmentHashMismatch):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": "HASH_MISMATCH"})
+		default:
+			log.Printf("Failed to store attachment chunk: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store chunk"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, upload)
+}
+
+// CancelUpload discards an unfinished upload
+func (h *AttachmentHandler) CancelUpload(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+	uploadID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+
+	err = h.attachments.CancelUpload(c.Request.Context(), userID, uploadID)
+	if errors.Is(err, repository.ErrUploadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found", "code": "UPLOAD_NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel upload"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "upload cancelled"})
+}
+
+// Download streams an attachment. Range requests are supported, so large
+// files can be fetched in parts and interrupted downloads resumed.
+func (h *AttachmentHandler) Download(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	f, attachment, err := h.attachments.Open(c.Request.Context(), userID, strings.ToLower(c.Param("hash")))
+	if errors.Is(err, repository.ErrAttachmentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attachment not found", "code": "ATTACHMENT_NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open attachment"})
+		return
+	}
+	defer f.Close()
+
+	// Content never changes for a hash
+	c.Header("ETag", `"`+attachment.Hash+`"`)
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, "", attachment.CreatedAt, f)
+}
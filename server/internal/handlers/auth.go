@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"errors"
+	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -11,26 +12,33 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/sprobst76/vibedtracker-server/internal/config"
+	"github.com/sprobst76/vibedtracker-server/internal/mail"
 	"github.com/sprobst76/vibedtracker-server/internal/middleware"
 	"github.com/sprobst76/vibedtracker-server/internal/models"
 	"github.com/sprobst76/vibedtracker-server/internal/repository"
 )
 
 type AuthHandler struct {
-	cfg       *config.Config
-	users     *repository.UserRepository
-	tokens    *repository.TokenRepository
-	devices   *repository.DeviceRepository
-	totpRepo  *repository.TOTPRepository
+	cfg           *config.Config
+	users         *repository.UserRepository
+	tokens        *repository.TokenRepository
+	devices       *repository.DeviceRepository
+	totpRepo      *repository.TOTPRepository
+	verifications *repository.EmailVerificationRepository
+	resets        *repository.PasswordResetRepository
+	mailer        mail.Mailer
 }
 
-func NewAuthHandler(cfg *config.Config, users *repository.UserRepository, tokens *repository.TokenRepository, devices *repository.DeviceRepository, totpRepo *repository.TOTPRepository) *AuthHandler {
+func NewAuthHandler(cfg *config.Config, users *repository.UserRepository, tokens *repository.TokenRepository, devices *repository.DeviceRepository, totpRepo *repository.TOTPRepository, verifications *repository.EmailVerificationRepository, resets *repository.PasswordResetRepository, mailer mail.Mailer) *AuthHandler {
 	return &AuthHandler{
-		cfg:      cfg,
-		users:    users,
-		tokens:   tokens,
-		devices:  devices,
-		totpRepo: totpRepo,
+		cfg:           cfg,
+		users:         users,
+		tokens:        tokens,
+		devices:       devices,
+		totpRepo:      totpRepo,
+		verifications: verifications,
+		resets:        resets,
+		mailer:        mailer,
 	}
 }
 
@@ -49,6 +57,11 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	// Normalize email to lowercase
 	email := strings.ToLower(strings.TrimSpace(req.Email))
 
+	if err := checkPasswordPolicy(req.Password, email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "WEAK_PASSWORD"})
+		return
+	}
+
 	// Hash password
 	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -66,12 +79,119 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
+	// A failed mail doesn't fail the registration; the user can request another one
+	if err := sendVerificationMail(c, h.cfg, h.verifications, h.mailer, user.ID, user.Email); err != nil {
+		log.Printf("Failed to send verification mail to user %s: %v", user.ID, err)
+	}
+
 	c.JSON(http.StatusCreated, gin.H{
-		"message": "registration successful, waiting for admin approval",
+		"message": "registration successful, please confirm your email address and wait for admin approval",
 		"user_id": user.ID,
 	})
 }
 
+// VerifyEmail confirms an email address with the token from the mail
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req models.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := h.verifications.Verify(c.Request.Context(), req.Token); err != nil {
+		if errors.Is(err, repository.ErrVerificationTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token", "code": "TOKEN_INVALID"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "email verified"})
+}
+
+// ResendVerification mails a new verification link. The response is the
+// same whether or not the address is registered, so it can't be used to
+// probe for accounts.
+func (h *AuthHandler) ResendVerification(c *gin.Context) {
+	var req models.ResendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	user, err := h.users.GetByEmail(c.Request.Context(), email)
+	if err == nil && !user.EmailVerified {
+		if err := sendVerificationMail(c, h.cfg, h.verifications, h.mailer, user.ID, user.Email); err != nil && !errors.Is(err, repository.ErrTooManyVerificationMails) {
+			log.Printf("Failed to send verification mail to user %s: %v", user.ID, err)
+		}
+	} else if err != nil && !errors.Is(err, repository.ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send verification mail"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "if the address is registered and not yet verified, a verification mail was sent"})
+}
+
+// ForgotPassword mails a link to set a new password. Like
+// ResendVerification it answers the same for unknown addresses.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	user, err := h.users.GetByEmail(c.Request.Context(), email)
+	if err == nil && !user.IsBlocked {
+		if err := sendPasswordResetMail(c, h.cfg, h.resets, h.mailer, user.ID, user.Email); err != nil && !errors.Is(err, repository.ErrTooManyPasswordResets) {
+			log.Printf("Failed to send password reset mail to user %s: %v", user.ID, err)
+		}
+	} else if err != nil && !errors.Is(err, repository.ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send password reset mail"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "if the address is registered, a password reset mail was sent"})
+}
+
+// ResetPassword sets a new password with the token from the mail and logs
+// out all devices. The E2E passphrase is independent of the account
+// password, so the encrypted data stays readable with it.
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkPasswordPolicy(req.Password, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "WEAK_PASSWORD"})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	if _, err := h.resets.Reset(c.Request.Context(), req.Token, string(hash)); err != nil {
+		if errors.Is(err, repository.ErrResetTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid, used or expired token", "code": "TOKEN_INVALID"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "password reset, all sessions were logged out; the encryption passphrase is unchanged",
+	})
+}
+
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req models.LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -133,16 +253,16 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	}
 
 	// Generate tokens (no TOTP required)
-	accessToken, err := middleware.GenerateAccessToken(user.ID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
+	refreshToken := middleware.GenerateRefreshToken()
+	session, err := h.tokens.Create(c.Request.Context(), user.ID, deviceID, refreshToken, time.Now().Add(h.cfg.RefreshExpiry), middleware.SessionClient(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
 		return
 	}
 
-	refreshToken := middleware.GenerateRefreshToken()
-	_, err = h.tokens.Create(c.Request.Context(), user.ID, deviceID, refreshToken, time.Now().Add(h.cfg.RefreshExpiry))
+	accessToken, err := middleware.GenerateAccessToken(user.ID, session.FamilyID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
@@ -168,7 +288,20 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 		return
 	}
 
-	if token.Revoked || token.ExpiresAt.Before(time.Now()) {
+	// A token rotated moments ago is most likely sent by a concurrent
+	// refresh of the same client, not by a thief
+	concurrent := false
+	if token.RotatedAt != nil {
+		if time.Since(*token.RotatedAt) > refreshReuseGrace {
+			h.tokenReused(c, token)
+			return
+		}
+		concurrent = true
+	} else if token.Revoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token expired or revoked"})
+		return
+	}
+	if token.ExpiresAt.Before(time.Now()) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token expired or revoked"})
 		return
 	}
@@ -184,65 +317,116 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 		return
 	}
 
-	accessToken, err := middleware.GenerateAccessToken(user.ID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
+	refreshToken := middleware.GenerateRefreshToken()
+	expiresAt := time.Now().Add(h.cfg.RefreshExpiry)
+	client := middleware.SessionClient(c)
+	if !concurrent {
+		_, err = h.tokens.Rotate(c.Request.Context(), token, refreshToken, expiresAt, client)
+		// Lost the race against a concurrent refresh with the same token
+		concurrent = errors.Is(err, repository.ErrTokenReused)
+	}
+	if concurrent {
+		_, err = h.tokens.RotateFamily(c.Request.Context(), token, refreshToken, expiresAt, client)
+	}
+	if err != nil {
+		if errors.Is(err, repository.ErrTokenNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token expired or revoked"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store refresh token"})
+		return
+	}
+
+	accessToken, err := middleware.GenerateAccessToken(user.ID, token.FamilyID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusOK, models.RefreshResponse{
-		AccessToken: accessToken,
-		ExpiresIn:   int64(h.cfg.JWTExpiry.Seconds()),
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(h.cfg.JWTExpiry.Seconds()),
 	})
 }
 
-func (h *AuthHandler) SetKey(c *gin.Context) {
-	userID, err := middleware.GetUserID(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
+// refreshReuseGrace is how long after its rotation a refresh token is still
+// accepted, so concurrent refreshes of one client don't count as theft
+const refreshReuseGrace = 30 * time.Second
 
-	var req models.SetKeyRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// tokenReused handles a refresh with an already rotated token. Either the
+// token was stolen or its holder lost the response carrying the successor;
+// both ways the whole family is revoked and the device has to log in again.
+func (h *AuthHandler) tokenReused(c *gin.Context, token *models.RefreshToken) {
+	log.Printf("Reuse of rotated refresh token of user %s on device %s, revoking token family", token.UserID, token.DeviceID)
+	if err := h.tokens.RevokeFamily(c.Request.Context(), token.FamilyID); err != nil {
+		log.Printf("Failed to revoke token family: %v", err)
 	}
-
-	// Decode base64
-	keySalt, err := decodeBase64(req.KeySalt)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key_salt format"})
-		return
+	if err := h.devices.FlagTokenReuse(c.Request.Context(), token.DeviceID); err != nil {
+		log.Printf("Failed to flag device: %v", err)
 	}
-	keyHash, err := decodeBase64(req.KeyVerificationHash)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token reuse detected", "code": "TOKEN_REUSED"})
+}
+
+func (h *AuthHandler) Me(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key_verification_hash format"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	if err := h.users.SetKeyInfo(c.Request.Context(), userID, keySalt, keyHash); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set key info"})
+	user, err := h.users.GetByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "key info saved"})
+	c.JSON(http.StatusOK, user)
 }
 
-func (h *AuthHandler) Me(c *gin.Context) {
+// ChangePassword sets a new password for the logged-in user and logs out
+// all other sessions
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
 	userID, err := middleware.GetUserID(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	user, err := h.users.GetByID(c.Request.Context(), userID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	// Access tokens from before sessions were tracked log out everywhere
+	sessionID, _ := middleware.GetSessionID(c)
+
+	err = changePassword(c.Request.Context(), h.users, h.tokens, h.totpRepo, user, sessionID, &req)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "password changed, other sessions were logged out"})
+	case errors.Is(err, repository.ErrTooManyAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed attempts, please try again later"})
+	case errors.Is(err, errWrongPassword):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": "INVALID_PASSWORD"})
+	case errors.Is(err, errTOTPCodeRequired):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": "TOTP_REQUIRED"})
+	case errors.Is(err, errWrongTOTPCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": "INVALID_TOTP"})
+	case errors.Is(err, errPasswordUnchanged):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "PASSWORD_UNCHANGED"})
+	case isPasswordPolicyError(err):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "WEAK_PASSWORD"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change password"})
+	}
 }
 
 // CreateInitialAdmin creates the first admin user if ADMIN_EMAIL and ADMIN_PASSWORD are set
@@ -267,5 +451,8 @@ func (h *AuthHandler) CreateInitialAdmin(ctx context.Context) error {
 		return err
 	}
 
+	if err := h.users.MarkEmailVerified(ctx, user.ID); err != nil {
+		return err
+	}
 	return h.users.MakeAdmin(ctx, user.ID)
 }
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ugorji/go/codec"
+)
+
+// Sync bodies can be sent as JSON (default) or CBOR, optionally compressed.
+// CBOR carries blobs and nonces as raw byte strings instead of Base64.
+const (
+	contentTypeCBOR = "application/cbor"
+
+	// Streamed responses: one JSON document per line, or concatenated CBOR items
+	contentTypeNDJSON  = "application/x-ndjson"
+	contentTypeCBORSeq = "application/cbor-seq"
+
+	// maxSyncBodyBytes limits the decompressed size of a sync request body
+	maxSyncBodyBytes = 64 << 20
+
+	// minCompressBytes skips compressing responses too small to benefit
+	minCompressBytes = 1024
+)
+
+var (
+	// The CBOR handle falls back to the json struct tags of the models
+	cborHandle = &codec.CborHandle{}
+
+	errSyncBodyTooLarge = errors.New("request body too large")
+)
+
+// readSyncBody reads the request body, undoing any Content-Encoding, and
+// writes the error response if it could not be read
+func readSyncBody(c *gin.Context) ([]byte, bool) {
+	var r io.Reader = c.Request.Body
+
+	switch encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid gzip body", "code": "INVALID_ENCODING"})
+			return nil, false
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(c.Request.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxSyncBodyBytes))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid zstd body", "code": "INVALID_ENCODING"})
+			return nil, false
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported content encoding: " + encoding, "code": "UNSUPPORTED_ENCODING"})
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, maxSyncBodyBytes+1))
+	if err == nil && len(body) > maxSyncBodyBytes {
+		err = errSyncBodyTooLarge
+	}
+	if errors.Is(err, errSyncBodyTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "code": "BODY_TOO_LARGE"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body", "code": "INVALID_ENCODING"})
+		return nil, false
+	}
+	return body, true
+}
+
+// decodeSyncBody decodes a body read by readSyncBody according to its
+// Content-Type and validates the binding tags
+func decodeSyncBody(c *gin.Context, body []byte, v any) bool {
+	var err error
+	switch c.ContentType() {
+	case contentTypeCBOR:
+		err = codec.NewDecoderBytes(body, cborHandle).Decode(v)
+	case binding.MIMEJSON, "":
+		err = json.Unmarshal(body, v)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported content type: " + c.ContentType(), "code": "UNSUPPORTED_MEDIA_TYPE"})
+		return false
+	}
+	if err == nil {
+		err = binding.Validator.ValidateStruct(v)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// encodeSyncBody encodes a response in the format the client accepts
+func encodeSyncBody(c *gin.Context, v any) (string, []byte, error) {
+	if c.NegotiateFormat(binding.MIMEJSON, contentTypeCBOR) == contentTypeCBOR {
+		var body []byte
+		if err := codec.NewEncoderBytes(&body, cborHandle).Encode(v); err != nil {
+			return "", nil, err
+		}
+		return contentTypeCBOR, body, nil
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return "", nil, err
+	}
+	return "application/json; charset=utf-8", body, nil
+}
+
+// writeSyncBody writes an encoded response, compressing it if the client
+// accepts zstd or gzip
+func writeSyncBody(c *gin.Context, status int, contentType string, body []byte) {
+	c.Header("Vary", "Accept, Accept-Encoding")
+
+	if len(body) >= minCompressBytes {
+		accept := c.GetHeader("Accept-Encoding")
+		var buf bytes.Buffer
+		switch {
+		case acceptsEncoding(accept, "zstd"):
+			zw, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+			if err == nil {
+				_, err = zw.Write(body)
+				if cerr := zw.Close(); err == nil {
+					err = cerr
+				}
+			}
+			if err == nil {
+				c.Header("Content-Encoding", "zstd")
+				body = buf.Bytes()
+			}
+		case acceptsEncoding(accept, "gzip"):
+			zw := gzip.NewWriter(&buf)
+			_, err := zw.Write(body)
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				c.Header("Content-Encoding", "gzip")
+				body = buf.Bytes()
+			}
+		}
+	}
+
+	c.Data(status, contentType, body)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the
+// given coding; a weight of q=0 refuses it
+func acceptsEncoding(header, coding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) {
+			continue
+		}
+		if weight, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(weight, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// syncStream writes a response as a sequence of records
+type syncStream struct {
+	encode     func(v any) error
+	compressor io.WriteCloser
+}
+
+// streamFormat negotiates the content type of a streamed response
+func streamFormat(c *gin.Context) string {
+	switch c.NegotiateFormat(contentTypeNDJSON, binding.MIMEJSON, contentTypeCBORSeq, contentTypeCBOR) {
+	case contentTypeCBORSeq, contentTypeCBOR:
+		return contentTypeCBORSeq
+	}
+	return contentTypeNDJSON
+}
+
+// openSyncStream writes the response headers of a streamed response in the
+// given format, compressed if the client accepts zstd or gzip
+func openSyncStream(c *gin.Context, status int, contentType string) *syncStream {
+	c.Header("Vary", "Accept, Accept-Encoding")
+	c.Header("Content-Type", contentType)
+
+	s := &syncStream{}
+	var w io.Writer = c.Writer
+	accept := c.GetHeader("Accept-Encoding")
+	switch {
+	case acceptsEncoding(accept, "zstd"):
+		if zw, err := zstd.NewWriter(c.Writer, zstd.WithEncoderConcurrency(1)); err == nil {
+			c.Header("Content-Encoding", "zstd")
+			s.compressor, w = zw, zw
+		}
+	case acceptsEncoding(accept, "gzip"):
+		zw := gzip.NewWriter(c.Writer)
+		c.Header("Content-Encoding", "gzip")
+		s.compressor, w = zw, zw
+	}
+	c.Status(status)
+
+	if contentType == contentTypeCBORSeq {
+		enc := codec.NewEncoder(w, cborHandle)
+		s.encode = enc.Encode
+	} else {
+		s.encode = json.NewEncoder(w).Encode
+	}
+	return s
+}
+
+// Write appends a record
+func (s *syncStream) Write(v any) error {
+	return s.encode(v)
+}
+
+// Close flushes the compressor; the stream must be closed even on errors
+func (s *syncStream) Close() error {
+	if s.compressor == nil {
+		return nil
+	}
+	return s.compressor.Close()
+}
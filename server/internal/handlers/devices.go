@@ -6,18 +6,21 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"github.com/sprobst76/vibedtracker-server/internal/config"
 	"github.com/sprobst76/vibedtracker-server/internal/middleware"
 	"github.com/sprobst76/vibedtracker-server/internal/models"
 	"github.com/sprobst76/vibedtracker-server/internal/repository"
 )
 
 type DeviceHandler struct {
+	cfg     *config.Config
 	devices *repository.DeviceRepository
 	tokens  *repository.TokenRepository
 }
 
-func NewDeviceHandler(devices *repository.DeviceRepository, tokens *repository.TokenRepository) *DeviceHandler {
+func NewDeviceHandler(cfg *config.Config, devices *repository.DeviceRepository, tokens *repository.TokenRepository) *DeviceHandler {
 	return &DeviceHandler{
+		cfg:     cfg,
 		devices: devices,
 		tokens:  tokens,
 	}
@@ -40,6 +43,19 @@ func (h *DeviceHandler) List(c *gin.Context) {
 		devices = []models.Device{}
 	}
 
+	ids := make([]uuid.UUID, len(devices))
+	for i := range devices {
+		ids[i] = devices[i].ID
+	}
+	health, err := h.devices.SyncHealth(c.Request.Context(), ids, h.cfg.StaleDeviceAfter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get devices"})
+		return
+	}
+	for i := range devices {
+		devices[i].SyncHealth = health[devices[i].ID]
+	}
+
 	c.JSON(http.StatusOK, gin.H{"devices": devices})
 }
 
@@ -100,3 +116,46 @@ func (h *DeviceHandler) Delete(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "device deleted"})
 }
+
+// UpdateCapabilities stores the app version and the schema versions per
+// data_type a device can decode. Apps call it after every update.
+func (h *DeviceHandler) UpdateCapabilities(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	deviceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device id"})
+		return
+	}
+
+	var req models.UpdateDeviceCapabilitiesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Verify device belongs to user
+	device, err := h.devices.GetByID(c.Request.Context(), deviceID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+
+	if device.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	if err := h.devices.UpdateCapabilities(c.Request.Context(), deviceID, req.AppVersion, req.SchemaVersions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update device"})
+		return
+	}
+
+	device.AppVersion = req.AppVersion
+	device.SchemaVersions = req.SchemaVersions
+	c.JSON(http.StatusOK, device)
+}
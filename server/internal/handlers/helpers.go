@@ -1,7 +1,121 @@
 package handlers
 
-import "encoding/base64"
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	cursorPrefix    = "v1:"
+	logCursorPrefix = "log1:"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
 
 func decodeBase64(s string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(s)
 }
+
+// encodeCursor turns a change sequence into an opaque sync cursor
+func encodeCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatInt(seq, 10)))
+}
+
+// decodeCursor parses a cursor created by encodeCursor; empty means "from the start"
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cursorPrefix) {
+		return 0, errInvalidCursor
+	}
+	seq, err := strconv.ParseInt(strings.TrimPrefix(string(raw), cursorPrefix), 10, 64)
+	if err != nil || seq < 0 {
+		return 0, errInvalidCursor
+	}
+	return seq, nil
+}
+
+// encodeLogCursor turns the position of the last returned sync log entry
+// into an opaque cursor
+func encodeLogCursor(createdAt time.Time, id uuid.UUID) string {
+	raw := logCursorPrefix + strconv.FormatInt(createdAt.UnixMicro(), 10) + ":" + id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeLogCursor parses a cursor created by encodeLogCursor
+func decodeLogCursor(cursor string) (time.Time, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), logCursorPrefix) {
+		return time.Time{}, uuid.Nil, errInvalidCursor
+	}
+	micros, idStr, found := strings.Cut(strings.TrimPrefix(string(raw), logCursorPrefix), ":")
+	if !found {
+		return time.Time{}, uuid.Nil, errInvalidCursor
+	}
+	usec, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errInvalidCursor
+	}
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errInvalidCursor
+	}
+	return time.UnixMicro(usec), id, nil
+}
+
+// formatBytes renders a byte count for humans, e.g. "1.5 MB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// compareVersions compares dotted app versions like "1.4.2" numerically.
+// A leading "v" and pre-release/build suffixes ("-beta", "+42") are ignored.
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, s := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(s)
+		parts = append(parts, n)
+	}
+	return parts
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/sprobst76/vibedtracker-server/internal/middleware"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+	"github.com/sprobst76/vibedtracker-server/internal/repository"
+)
+
+// KeyRotationHandler coordinates a passphrase change: one device re-encrypts
+// all items with the new key while the others pause pushing, then the new key
+// info is committed atomically.
+type KeyRotationHandler struct {
+	sync    *repository.SyncRepository
+	devices *repository.DeviceRepository
+}
+
+func NewKeyRotationHandler(sync *repository.SyncRepository, devices *repository.DeviceRepository) *KeyRotationHandler {
+	return &KeyRotationHandler{
+		sync:    sync,
+		devices: devices,
+	}
+}
+
+// Get returns the key generation and the progress of a running rotation
+func (h *KeyRotationHandler) Get(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	status, err := h.sync.GetKeyRotation(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get key rotation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Start registers the new key info and makes the device the rotating device
+func (h *KeyRotationHandler) Start(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.StartKeyRotationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := userDevice(c, h.devices, userID, deviceID); !ok {
+		return
+	}
+	keySalt, err := decodeBase64(req.NewKeySalt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid new_key_salt format"})
+		return
+	}
+	keyHash, err := decodeBase64(req.NewKeyVerificationHash)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid new_key_verification_hash format"})
+		return
+	}
+
+	status, err := h.sync.StartKeyRotation(c.Request.Context(), userID, deviceID, keySalt, keyHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrRotationInProgress):
+			c.JSON(http.StatusConflict, gin.H{"error": "a key rotation is already in progress", "code": "ROTATION_IN_PROGRESS"})
+		case errors.Is(err, repository.ErrNoKeyInfo):
+			c.JSON(http.StatusConflict, gin.H{"error": "no encryption key set up yet", "code": "NO_KEY"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start key rotation"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Items stores a batch of items re-encrypted with the new key. Only the
+// rotating device may send them; the response reports the remaining work.
+func (h *KeyRotationHandler) Items(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.SyncPushRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := userDevice(c, h.devices, userID, deviceID); !ok {
+		return
+	}
+
+	status, err := h.sync.GetKeyRotation(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get key rotation"})
+		return
+	}
+	if !status.InProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "no key rotation in progress", "code": "NO_ROTATION"})
+		return
+	}
+
+	results, err := h.sync.PushItems(c.Request.Context(), userID, deviceID, req.Items)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrRotationInProgress):
+			c.JSON(http.StatusLocked, gin.H{"error": "key rotation is run by another device", "code": "ROTATION_IN_PROGRESS"})
+		case errors.Is(err, repository.ErrPushRejected):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sync push rejected", "code": "PUSH_REJECTED", "results": results})
+		case errors.Is(err, repository.ErrQuotaExceeded):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "storage quota exceeded", "code": "QUOTA_EXCEEDED", "results": results})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store items", "results": results})
+		}
+		return
+	}
+
+	status, err = h.sync.GetKeyRotation(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get key rotation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results":  results,
+		"rotation": status,
+	})
+}
+
+// Commit swaps in the new key info once no item is left under the old key
+func (h *KeyRotationHandler) Commit(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.KeyRotationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := userDevice(c, h.devices, userID, deviceID); !ok {
+		return
+	}
+
+	status, err := h.sync.CommitKeyRotation(c.Request.Context(), userID, deviceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNoRotation):
+			c.JSON(http.StatusConflict, gin.H{"error": "no key rotation in progress", "code": "NO_ROTATION"})
+		case errors.Is(err, repository.ErrRotationInProgress):
+			c.JSON(http.StatusLocked, gin.H{"error": "key rotation is run by another device", "code": "ROTATION_IN_PROGRESS"})
+		case errors.Is(err, repository.ErrRotationIncomplete):
+			c.JSON(http.StatusConflict, gin.H{"error": "items are still encrypted with the old key", "code": "ROTATION_INCOMPLETE", "rotation": status})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit key rotation"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Abort cancels a running rotation and reverts items already re-encrypted.
+// Any device of the user may abort, e.g. if the rotating device got lost.
+func (h *KeyRotationHandler) Abort(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.KeyRotationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := userDevice(c, h.devices, userID, deviceID); !ok {
+		return
+	}
+
+	n, err := h.sync.AbortKeyRotation(c.Request.Context(), userID, deviceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNoRotation):
+			c.JSON(http.StatusConflict, gin.H{"error": "no key rotation in progress", "code": "NO_ROTATION"})
+		case errors.Is(err, repository.ErrAbortLosesItems):
+			// Finishing the rotation is the only way to keep them
+			c.JSON(http.StatusConflict, gin.H{"error": "re-encrypted items have no version under the old key, commit the rotation instead", "code": "ABORT_LOSES_ITEMS", "unrecoverable_items": n})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to abort key rotation"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "key rotation aborted",
+		"reverted_items": n,
+	})
+}
+
+// approvedUser returns the authenticated user, writing the error response if
+// the user is unknown or not approved for sync
+func approvedUser(c *gin.Context) (uuid.UUID, bool) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return uuid.Nil, false
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return uuid.Nil, false
+	}
+
+	return userID, true
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/sprobst76/vibedtracker-server/internal/config"
+	"github.com/sprobst76/vibedtracker-server/internal/mail"
+	"github.com/sprobst76/vibedtracker-server/internal/repository"
+)
+
+// mailTimeout bounds sending a single mail
+const mailTimeout = 15 * time.Second
+
+// sendMailAsync sends a mail in the background, so the response time does
+// not reveal whether a mail was sent, i.e. whether an account exists.
+// Failures are only logged.
+func sendMailAsync(mailer mail.Mailer, msg mail.Message, userID uuid.UUID) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send mail %q to user %s: %v", msg.Subject, userID, err)
+		}
+	}()
+}
+
+// sendVerificationMail issues a verification token for the user and mails
+// the link to confirm the address. The mail is sent in the background; only
+// issuing the token can fail.
+func sendVerificationMail(c *gin.Context, cfg *config.Config, verifications *repository.EmailVerificationRepository, mailer mail.Mailer, userID uuid.UUID, email string) error {
+	token, err := verifications.Create(c.Request.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.PublicURL + "/web/verify-email?token=" + url.QueryEscape(token)
+	sendMailAsync(mailer, mail.Message{
+		To:      email,
+		Subject: "VibedTracker: E-Mail-Adresse bestätigen",
+		Body: fmt.Sprintf(`Hallo,
+
+bitte bestätige deine E-Mail-Adresse für VibedTracker:
+
+%s
+
+Der Link ist %d Stunden gültig. Falls du dich nicht registriert hast, kannst du diese E-Mail ignorieren.
+`, link, int(repository.EmailVerificationExpiry.Hours())),
+	}, userID)
+	return nil
+}
+
+// sendPasswordResetMail issues a reset token for the user and mails the link
+// to set a new password. The mail is sent in the background; only issuing
+// the token can fail.
+func sendPasswordResetMail(c *gin.Context, cfg *config.Config, resets *repository.PasswordResetRepository, mailer mail.Mailer, userID uuid.UUID, email string) error {
+	token, err := resets.Create(c.Request.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.PublicURL + "/web/reset-password?token=" + url.QueryEscape(token)
+	sendMailAsync(mailer, mail.Message{
+		To:      email,
+		Subject: "VibedTracker: Passwort zurücksetzen",
+		Body: fmt.Sprintf(`Hallo,
+
+für dein VibedTracker-Konto wurde ein neues Passwort angefordert. Über diesen Link kannst du es festlegen:
+
+%s
+
+Der Link ist %d Minuten gültig und kann nur einmal verwendet werden. Danach werden alle Geräte abgemeldet.
+
+Deine Verschlüsselungs-Passphrase ist davon nicht betroffen und bleibt unverändert. Ohne sie können deine Daten weiterhin nicht entschlüsselt werden.
+
+Falls du das nicht angefordert hast, kannst du diese E-Mail ignorieren. Dein Passwort bleibt dann unverändert.
+`, link, int(repository.PasswordResetExpiry.Minutes())),
+	}, userID)
+	return nil
+}
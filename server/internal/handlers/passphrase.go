@@ -59,6 +59,19 @@ func (h *PassphraseHandler) SetKey(c *gin.Context) {
 	}
 	isFirstSetup := user.KeySalt == nil || len(user.KeySalt) == 0
 
+	// Existing data stays encrypted with the old key; changing it needs a rotation
+	if !isFirstSetup {
+		hasData, err := h.users.HasSyncData(c.Request.Context(), userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+			return
+		}
+		if hasData {
+			c.JSON(http.StatusConflict, gin.H{"error": "existing data must be re-encrypted, use key rotation", "code": "KEY_ROTATION_REQUIRED"})
+			return
+		}
+	}
+
 	// Store key info
 	if err := h.users.SetKeyInfo(c.Request.Context(), userID, keySalt, keyHash); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set key info"})
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+	"github.com/sprobst76/vibedtracker-server/internal/repository"
+)
+
+// Password policy for account passwords. The E2E passphrase is chosen and
+// checked on the client and not affected by it.
+const (
+	minPasswordLength = 8
+	maxPasswordBytes  = 72 // bcrypt ignores everything beyond
+)
+
+var (
+	errPasswordTooShort  = errors.New("password must be at least 8 characters")
+	errPasswordTooLong   = errors.New("password must be at most 72 bytes")
+	errPasswordIsEmail   = errors.New("password must not be the email address")
+	errPasswordTooSimple = errors.New("password must contain letters and digits or symbols")
+
+	errWrongPassword     = errors.New("invalid current password")
+	errTOTPCodeRequired  = errors.New("TOTP code required")
+	errWrongTOTPCode     = errors.New("invalid TOTP code")
+	errPasswordUnchanged = errors.New("new password must differ from the current one")
+)
+
+// checkPasswordPolicy returns why a new password is not acceptable, or nil.
+// The email check is skipped if email is empty.
+func checkPasswordPolicy(password, email string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return errPasswordTooShort
+	}
+	if len(password) > maxPasswordBytes {
+		return errPasswordTooLong
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		return errPasswordIsEmail
+	}
+
+	var letter, other bool
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			letter = true
+		} else if !unicode.IsSpace(r) {
+			other = true
+		}
+	}
+	if !letter || !other {
+		return errPasswordTooSimple
+	}
+	return nil
+}
+
+func isPasswordPolicyError(err error) bool {
+	return errors.Is(err, errPasswordTooShort) || errors.Is(err, errPasswordTooLong) ||
+		errors.Is(err, errPasswordIsEmail) || errors.Is(err, errPasswordTooSimple)
+}
+
+// passwordPolicyMessage is the German text of a policy violation for the
+// web frontend
+func passwordPolicyMessage(err error) string {
+	switch {
+	case errors.Is(err, errPasswordTooShort):
+		return "Das Passwort muss mindestens 8 Zeichen lang sein"
+	case errors.Is(err, errPasswordTooLong):
+		return "Das Passwort darf höchstens 72 Bytes lang sein"
+	case errors.Is(err, errPasswordIsEmail):
+		return "Das Passwort darf nicht die E-Mail-Adresse sein"
+	case errors.Is(err, errPasswordTooSimple):
+		return "Das Passwort muss Buchstaben und Ziffern oder Sonderzeichen enthalten"
+	}
+	return "Ungültiges Passwort"
+}
+
+// changePassword sets a new password after checking the current one and,
+// if enabled, a TOTP code. Failed checks count towards the TOTP rate limit.
+// All sessions except keepSession are logged out; with uuid.Nil (session
+// unknown) all of them are.
+//
+// Shared with the web frontend.
+func changePassword(ctx context.Context, users *repository.UserRepository, tokens *repository.TokenRepository, totpRepo *repository.TOTPRepository, user *models.User, keepSession uuid.UUID, req *models.ChangePasswordRequest) error {
+	if err := totpRepo.CheckRateLimit(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+		totpRepo.RecordAttempt(ctx, user.ID, false)
+		return errWrongPassword
+	}
+	if user.TOTPEnabled {
+		if req.Code == "" {
+			return errTOTPCodeRequired
+		}
+		if !totp.Validate(req.Code, string(user.TOTPSecret)) {
+			totpRepo.RecordAttempt(ctx, user.ID, false)
+			return errWrongTOTPCode
+		}
+	}
+
+	if err := checkPasswordPolicy(req.NewPassword, user.Email); err != nil {
+		return err
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return errPasswordUnchanged
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := users.UpdatePassword(ctx, user.ID, string(hash)); err != nil {
+		return err
+	}
+	totpRepo.RecordAttempt(ctx, user.ID, true)
+
+	if keepSession == uuid.Nil {
+		return tokens.RevokeByUserID(ctx, user.ID)
+	}
+	_, err = tokens.RevokeOtherSessions(ctx, user.ID, keepSession)
+	return err
+}
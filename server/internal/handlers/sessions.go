@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/sprobst76/vibedtracker-server/internal/middleware"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+	"github.com/sprobst76/vibedtracker-server/internal/repository"
+)
+
+// SessionHandler lets users review and end their logins. A session is a
+// refresh token family; ending it stops further refreshes, access tokens
+// already issued stay valid until they expire.
+type SessionHandler struct {
+	tokens *repository.TokenRepository
+}
+
+func NewSessionHandler(tokens *repository.TokenRepository) *SessionHandler {
+	return &SessionHandler{tokens: tokens}
+}
+
+// List returns the live sessions of the user
+func (h *SessionHandler) List(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	sessions, err := h.tokens.ListSessions(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get sessions"})
+		return
+	}
+	if sessions == nil {
+		sessions = []models.Session{}
+	}
+
+	if current, err := middleware.GetSessionID(c); err == nil {
+		markCurrentSession(sessions, current)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// Revoke ends one session, which may be the current one
+func (h *SessionHandler) Revoke(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	sessionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+
+	if err := h.tokens.RevokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		if errors.Is(err, repository.ErrTokenNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// RevokeOthers ends all sessions except the one of the access token
+func (h *SessionHandler) RevokeOthers(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	current, err := middleware.GetSessionID(c)
+	if err != nil {
+		// Access token from before sessions were tracked; a refresh fixes it
+		c.JSON(http.StatusBadRequest, gin.H{"error": "current session unknown, refresh the access token", "code": "SESSION_UNKNOWN"})
+		return
+	}
+
+	revoked, err := h.tokens.RevokeOtherSessions(c.Request.Context(), userID, current)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
+
+// markCurrentSession flags the session a request was made with
+func markCurrentSession(sessions []models.Session, current uuid.UUID) {
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+}
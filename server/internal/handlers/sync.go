@@ -1,26 +1,58 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"github.com/sprobst76/vibedtracker-server/internal/config"
 	"github.com/sprobst76/vibedtracker-server/internal/middleware"
 	"github.com/sprobst76/vibedtracker-server/internal/models"
 	"github.com/sprobst76/vibedtracker-server/internal/repository"
 )
 
+const (
+	DefaultPullLimit = 500
+	MaxPullLimit     = 1000
+
+	DefaultSyncLogLimit = 100
+	MaxSyncLogLimit     = 500
+)
+
+// syncEventHeartbeat keeps idle event streams alive through proxies
+const syncEventHeartbeat = 25 * time.Second
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+)
+
 type SyncHandler struct {
-	sync    *repository.SyncRepository
-	devices *repository.DeviceRepository
+	cfg         *config.Config
+	sync        *repository.SyncRepository
+	devices     *repository.DeviceRepository
+	events      *repository.SyncEvents
+	idempotency *repository.IdempotencyRepository
 }
 
-func NewSyncHandler(sync *repository.SyncRepository, devices *repository.DeviceRepository) *SyncHandler {
+func NewSyncHandler(cfg *config.Config, sync *repository.SyncRepository, devices *repository.DeviceRepository, events *repository.SyncEvents, idempotency *repository.IdempotencyRepository) *SyncHandler {
 	return &SyncHandler{
-		sync:    sync,
-		devices: devices,
+		cfg:         cfg,
+		sync:        sync,
+		devices:     devices,
+		events:      events,
+		idempotency: idempotency,
 	}
 }
 
@@ -38,9 +70,13 @@ func (h *SyncHandler) Push(c *gin.Context) {
 		return
 	}
 
+	// Keep the raw body around to fingerprint it for the idempotency key
+	body, ok := readSyncBody(c)
+	if !ok {
+		return
+	}
 	var req models.SyncPushRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !decodeSyncBody(c, body, &req) {
 		return
 	}
 
@@ -50,22 +86,180 @@ func (h *SyncHandler) Push(c *gin.Context) {
 		return
 	}
 
-	if err := h.sync.PushItems(c.Request.Context(), userID, deviceID, req.Items); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "sync push failed"})
+	device, ok := h.userDevice(c, userID, deviceID)
+	if !ok {
+		return
+	}
+	if h.rejectOutdatedClient(c, device, req.Items) {
+		return
+	}
+
+	idempotencyKey := c.GetHeader(idempotencyKeyHeader)
+	if idempotencyKey != "" {
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "idempotency key too long", "code": "INVALID_IDEMPOTENCY_KEY"})
+			return
+		}
+
+		hash := sha256.Sum256(body)
+
+		record, err := h.idempotency.Claim(c.Request.Context(), userID, idempotencyKey, hex.EncodeToString(hash[:]), time.Now())
+		switch {
+		case errors.Is(err, repository.ErrIdempotencyKeyReused):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "idempotency key was used for a different request", "code": "IDEMPOTENCY_KEY_REUSED"})
+			return
+		case errors.Is(err, repository.ErrIdempotencyKeyInProgress):
+			c.JSON(http.StatusConflict, gin.H{"error": "request with this idempotency key is still in progress", "code": "IDEMPOTENCY_KEY_IN_PROGRESS"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "sync push failed"})
+			return
+		case record != nil:
+			// Already applied, answer with the original response
+			c.Header("Idempotent-Replayed", "true")
+			writeSyncBody(c, *record.StatusCode, record.ContentType, record.Response)
+			return
+		}
+	}
+
+	results, err := h.sync.PushItems(c.Request.Context(), userID, deviceID, req.Items)
+	if err != nil {
+		if errors.Is(err, repository.ErrPushRejected) {
+			h.respondIdempotent(c, userID, idempotencyKey, http.StatusBadRequest, gin.H{"error": "sync push rejected", "code": "PUSH_REJECTED", "results": results})
+			return
+		}
+		if errors.Is(err, repository.ErrQuotaExceeded) || errors.Is(err, repository.ErrRotationInProgress) {
+			// Not stored: the push may succeed later
+			if idempotencyKey != "" {
+				_ = h.idempotency.Release(c.Request.Context(), userID, idempotencyKey)
+			}
+			if errors.Is(err, repository.ErrRotationInProgress) {
+				c.JSON(http.StatusLocked, gin.H{"error": "key rotation in progress, retry after it finished", "code": "ROTATION_IN_PROGRESS", "results": results})
+				return
+			}
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "storage quota exceeded", "code": "QUOTA_EXCEEDED", "results": results})
+			return
+		}
+		// Nothing was written, let a retry with the same key run again
+		if idempotencyKey != "" {
+			_ = h.idempotency.Release(c.Request.Context(), userID, idempotencyKey)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "sync push failed", "results": results})
 		return
 	}
 
 	// Update device last sync
 	_ = h.devices.UpdateLastSync(c.Request.Context(), deviceID)
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":    "sync successful",
-		"items_count": len(req.Items),
-		"timestamp":  time.Now().Unix(),
+	conflicts := 0
+	for _, result := range results {
+		if result.Status == models.SyncItemStatusConflict {
+			conflicts++
+		}
+	}
+
+	h.respondIdempotent(c, userID, idempotencyKey, http.StatusOK, models.SyncPushResponse{
+		Message:    "sync successful",
+		ItemsCount: len(req.Items),
+		Conflicts:  conflicts,
+		Timestamp:  time.Now().Unix(),
+		Results:    results,
 	})
 }
 
+func (h *SyncHandler) userDevice(c *gin.Context, userID, deviceID uuid.UUID) (*models.Device, bool) {
+	return userDevice(c, h.devices, userID, deviceID)
+}
+
+// userDevice loads a device of the user, writing the error response if it
+// does not exist or belongs to someone else
+func userDevice(c *gin.Context, devices *repository.DeviceRepository, userID, deviceID uuid.UUID) (*models.Device, bool) {
+	device, err := devices.GetByID(c.Request.Context(), deviceID)
+	if errors.Is(err, repository.ErrDeviceNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown device_id"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get device"})
+		return nil, false
+	}
+	if device.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil, false
+	}
+	return device, true
+}
+
+// rejectOutdatedClient answers 426 UPGRADE_REQUIRED if the device runs an app
+// older than MIN_APP_VERSION or pushes items below MIN_SCHEMA_VERSIONS. A
+// device that never reported its version counts as older.
+func (h *SyncHandler) rejectOutdatedClient(c *gin.Context, device *models.Device, items []models.SyncPushItem) bool {
+	if h.cfg.MinAppVersion != "" && (device.AppVersion == "" || compareVersions(device.AppVersion, h.cfg.MinAppVersion) < 0) {
+		c.JSON(http.StatusUpgradeRequired, gin.H{
+			"error":           "app version too old, please update",
+			"code":            "UPGRADE_REQUIRED",
+			"min_app_version": h.cfg.MinAppVersion,
+		})
+		return true
+	}
+
+	var results []models.SyncPushResult
+	outdated := false
+	for i, item := range items {
+		result := models.SyncPushResult{Index: i, DataType: item.DataType, LocalID: item.LocalID, Status: models.SyncItemStatusSkipped}
+		schemaVersion := item.SchemaVersion
+		if schemaVersion == 0 {
+			schemaVersion = 1
+		}
+		if minVersion, ok := h.cfg.MinSchemaVersions[item.DataType]; ok && !item.Deleted && schemaVersion < minVersion {
+			result.Status = models.SyncItemStatusFailed
+			result.Error = fmt.Sprintf("schema_version %d is below the minimum %d", schemaVersion, minVersion)
+			outdated = true
+		}
+		results = append(results, result)
+	}
+	if !outdated {
+		return false
+	}
+
+	c.JSON(http.StatusUpgradeRequired, gin.H{
+		"error":               "schema version too old, please update",
+		"code":                "UPGRADE_REQUIRED",
+		"min_schema_versions": h.cfg.MinSchemaVersions,
+		"results":             results,
+	})
+	return true
+}
+
+// respondIdempotent writes the response and stores it for replays if the
+// request carried an idempotency key
+func (h *SyncHandler) respondIdempotent(c *gin.Context, userID uuid.UUID, key string, status int, response any) {
+	contentType, body, err := encodeSyncBody(c, response)
+	if err != nil {
+		if key != "" {
+			_ = h.idempotency.Release(c.Request.Context(), userID, key)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encode response"})
+		return
+	}
+	if key == "" {
+		writeSyncBody(c, status, contentType, body)
+		return
+	}
+
+	// The push is committed at this point, so store the response even if the
+	// client has already gone away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.idempotency.Complete(ctx, userID, key, status, contentType, body); err != nil {
+		log.Printf("Failed to store idempotent response: %v", err)
+	}
+
+	writeSyncBody(c, status, contentType, body)
+}
+
 func (h *SyncHandler) Pull(c *gin.Context) {
+	started := time.Now()
 	userID, err := middleware.GetUserID(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
@@ -91,8 +285,42 @@ func (h *SyncHandler) Pull(c *gin.Context) {
 		return
 	}
 
-	since := time.Unix(req.Since, 0)
-	items, err := h.sync.PullItems(c.Request.Context(), userID, since, req.DataType)
+	device, ok := h.userDevice(c, userID, deviceID)
+	if !ok {
+		return
+	}
+
+	afterSeq, err := decodeCursor(req.Cursor)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor", "code": "INVALID_CURSOR"})
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DefaultPullLimit
+	}
+	if limit > MaxPullLimit {
+		limit = MaxPullLimit
+	}
+
+	legacy := req.Cursor == "" && req.Since > 0
+	var items []models.SyncPullItem
+	var hasMore bool
+	if legacy {
+		// The previous pull is acknowledged by its timestamp
+		afterSeq, err = h.sync.SeqSince(c.Request.Context(), userID, time.Unix(req.Since, 0))
+		if err == nil {
+			items, err = h.pullAll(c.Request.Context(), userID, afterSeq, req.DataType)
+		}
+	} else {
+		items, hasMore, err = h.sync.PullItems(c.Request.Context(), userID, afterSeq, req.DataType, limit)
+	}
+	if errors.Is(err, repository.ErrResyncRequired) {
+		// Deletions after this cursor were purged; the device must start over
+		c.JSON(http.StatusGone, gin.H{"error": "cursor is older than the purge horizon, full resync required", "code": "RESYNC_REQUIRED"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "sync pull failed"})
 		return
@@ -102,14 +330,61 @@ func (h *SyncHandler) Pull(c *gin.Context) {
 		items = []models.SyncPullItem{}
 	}
 
-	// Log the pull
-	_ = h.sync.LogPull(c.Request.Context(), userID, deviceID, len(items))
+	// Flag items the device cannot decode so the app can ask for an update
+	unsupported := 0
+	for i := range items {
+		if maxVersion, ok := device.SchemaVersions[items[i].DataType]; ok && !items[i].Deleted && items[i].SchemaVersion > maxVersion {
+			items[i].Unsupported = true
+			unsupported++
+		}
+	}
+
+	nextSeq := afterSeq
+	if len(items) > 0 {
+		nextSeq = items[len(items)-1].Seq
+	}
+
+	// Log the pull; the cursor it was sent with is acknowledged by the device
+	_ = h.sync.LogPull(c.Request.Context(), userID, deviceID, items, started)
 	_ = h.devices.UpdateLastSync(c.Request.Context(), deviceID)
+	_ = h.devices.AckCursor(c.Request.Context(), deviceID, req.DataType, afterSeq)
 
-	c.JSON(http.StatusOK, models.SyncPullResponse{
-		Items:     items,
-		Timestamp: time.Now().Unix(),
+	contentType, body, err := encodeSyncBody(c, models.SyncPullResponse{
+		Items:            items,
+		NextCursor:       encodeCursor(nextSeq),
+		HasMore:          hasMore,
+		UnsupportedCount: unsupported,
+		Timestamp:        started.Unix(), // Old apps pull "since" this next time
 	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encode response"})
+		return
+	}
+	writeSyncBody(c, http.StatusOK, contentType, body)
+}
+
+// pullAll serves apps from before cursors, which send the timestamp of
+// their last pull and ignore has_more: all changes after afterSeq are
+// collected into one response. Purged deletions can't be detected by
+// timestamp, so past the purge horizon it pulls from the beginning instead
+// of failing.
+func (h *SyncHandler) pullAll(ctx context.Context, userID uuid.UUID, afterSeq int64, dataType string) ([]models.SyncPullItem, error) {
+	var items []models.SyncPullItem
+	for {
+		page, hasMore, err := h.sync.PullItems(ctx, userID, afterSeq, dataType, MaxPullLimit)
+		if errors.Is(err, repository.ErrResyncRequired) && len(items) == 0 {
+			afterSeq = 0
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		if !hasMore {
+			return items, nil
+		}
+		afterSeq = page[len(page)-1].Seq
+	}
 }
 
 func (h *SyncHandler) Status(c *gin.Context) {
@@ -121,9 +396,664 @@ func (h *SyncHandler) Status(c *gin.Context) {
 
 	isApproved, _ := c.Get("is_approved")
 
+	storage, err := h.sync.GetStorageUsage(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get storage usage"})
+		return
+	}
+
+	// Devices other than rotation.device_id must pause pushing while in_progress
+	rotation, err := h.sync.GetKeyRotation(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get key rotation"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"user_id":     userID,
-		"is_approved": isApproved,
-		"timestamp":   time.Now().Unix(),
+		"user_id":             userID,
+		"is_approved":         isApproved,
+		"storage":             storage,
+		"key_rotation":        rotation,
+		"min_app_version":     h.cfg.MinAppVersion,
+		"min_schema_versions": h.cfg.MinSchemaVersions,
+		"timestamp":           time.Now().Unix(),
+	})
+}
+
+// Snapshot streams the live items of the account together with the cursor
+// they correspond to, so a new device can bootstrap without replaying the
+// whole change history. The ETag changes with every write.
+func (h *SyncHandler) Snapshot(c *gin.Context) {
+	started := time.Now()
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.SyncSnapshotRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+
+	device, ok := h.userDevice(c, userID, deviceID)
+	if !ok {
+		return
+	}
+
+	seq, err := h.sync.SnapshotSeq(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create snapshot"})
+		return
+	}
+
+	// Unsupported flags depend on the device, so its schema versions are part of the tag
+	contentType := streamFormat(c)
+	schemaVersions, _ := json.Marshal(device.SchemaVersions)
+	tag := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%s|%s", seq, req.DataType, contentType, deviceID, schemaVersions)))
+	etag := `"` + hex.EncodeToString(tag[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	stream := openSyncStream(c, http.StatusOK, contentType)
+	defer stream.Close()
+
+	err = stream.Write(models.SnapshotHeader{
+		Format:      models.SnapshotFormat,
+		Version:     models.SnapshotVersion,
+		Cursor:      encodeCursor(seq),
+		DataType:    req.DataType,
+		GeneratedAt: time.Now().Unix(),
+	})
+	trailer := models.SnapshotTrailer{Complete: true}
+	if err == nil {
+		err = h.sync.StreamSnapshot(c.Request.Context(), userID, deviceID, req.DataType, seq, started, func(item *models.SyncPullItem) error {
+			if maxVersion, ok := device.SchemaVersions[item.DataType]; ok && item.SchemaVersion > maxVersion {
+				item.Unsupported = true
+				trailer.UnsupportedCount++
+			}
+			trailer.ItemCount++
+			return stream.Write(item)
+		})
+	}
+	if err != nil {
+		// Without the trailer the client knows the snapshot is incomplete
+		log.Printf("Snapshot for user %s aborted: %v", userID, err)
+		c.Abort()
+		return
+	}
+	if err := stream.Write(trailer); err != nil {
+		log.Printf("Snapshot for user %s aborted: %v", userID, err)
+		return
+	}
+
+	_ = h.devices.UpdateLastSync(c.Request.Context(), deviceID)
+}
+
+// etagMatches compares an If-None-Match header with an ETag. Like the
+// header demands, weak tags (added by compressing proxies) match as well.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// DataTypes lists the data types the server accepts with their limits.
+// Blob limits already include the server-wide maximum item size.
+func (h *SyncHandler) DataTypes(c *gin.Context) {
+	if _, err := middleware.GetUserID(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	dataTypes := make([]models.DataTypeSpec, len(models.DataTypes))
+	for i, spec := range models.DataTypes {
+		spec.MaxBlobBytes = spec.BlobLimit(h.cfg.MaxItemBytes)
+		dataTypes[i] = spec
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data_types": dataTypes})
+}
+
+// ListRevisions returns the archived versions of a single item
+func (h *SyncHandler) ListRevisions(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return
+	}
+
+	var req models.SyncRevisionsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revisions, err := h.sync.ListRevisions(c.Request.Context(), userID, req.DataType, req.LocalID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get revisions"})
+		return
+	}
+
+	if revisions == nil {
+		revisions = []models.SyncRevision{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
+
+// RestoreRevision makes an archived version the current version of its item
+func (h *SyncHandler) RestoreRevision(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return
+	}
+
+	revisionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid revision id"})
+		return
+	}
+
+	var req models.RestoreRevisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+
+	if _, ok := h.userDevice(c, userID, deviceID); !ok {
+		return
+	}
+
+	result, err := h.sync.RestoreRevision(c.Request.Context(), userID, deviceID, revisionID)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrRevisionNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "revision not found"})
+		case errors.Is(err, repository.ErrStaleKeyGeneration):
+			c.JSON(http.StatusConflict, gin.H{"error": "revision is encrypted with an outdated key", "code": "STALE_KEY_GENERATION"})
+		case errors.Is(err, repository.ErrRotationInProgress):
+			c.JSON(http.StatusLocked, gin.H{"error": "key rotation in progress, retry after it finished", "code": "ROTATION_IN_PROGRESS"})
+		case errors.Is(err, repository.ErrPushRejected):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "restore rejected", "code": "RESTORE_REJECTED", "result": result})
+		case errors.Is(err, repository.ErrQuotaExceeded):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "storage quota exceeded", "code": "QUOTA_EXCEEDED"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore revision"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// RestoreAccount sets every item back to the version it had at a point in time
+func (h *SyncHandler) RestoreAccount(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return
+	}
+
+	var req models.RestoreAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := h.userDevice(c, userID, deviceID); !ok {
+		return
+	}
+
+	at := time.Unix(req.Timestamp, 0)
+	if at.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timestamp must not be in the future"})
+		return
+	}
+
+	summary, err := h.sync.RestoreToTime(c.Request.Context(), userID, deviceID, at)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrRotationInProgress):
+			c.JSON(http.StatusLocked, gin.H{"error": "key rotation in progress, retry after it finished", "code": "ROTATION_IN_PROGRESS"})
+		case errors.Is(err, repository.ErrPushRejected):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "restore rejected", "code": "RESTORE_REJECTED"})
+		case errors.Is(err, repository.ErrQuotaExceeded):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "storage quota exceeded", "code": "QUOTA_EXCEEDED"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore account"})
+		}
+		return
+	}
+
+	summary.Timestamp = time.Now().Unix()
+	c.JSON(http.StatusOK, summary)
+}
+
+// Purge permanently removes all soft-deleted items of the user together with
+// their revision history. Other devices are told to resync on their next pull.
+func (h *SyncHandler) Purge(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return
+	}
+
+	var req models.PurgeDeletedRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := h.userDevice(c, userID, deviceID); !ok {
+		return
+	}
+
+	purged, err := h.sync.PurgeDeletedItems(c.Request.Context(), userID, deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to purge deleted items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "deleted items purged",
+		"purged_count": purged,
+		"timestamp":    time.Now().Unix(),
+	})
+}
+
+// Export streams all live items of the user together with the key info as a
+// vault archive. The contents stay encrypted; it is meant as offline backup
+// and for moving to another server.
+func (h *SyncHandler) Export(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return
+	}
+
+	started := false
+	first := true
+	err = h.sync.ExportVault(c.Request.Context(), userID,
+		func(keySalt, keyVerificationHash []byte) error {
+			header, err := json.Marshal(models.VaultHeader{
+				Format:              models.VaultArchiveFormat,
+				Version:             models.VaultArchiveVersion,
+				ExportedAt:          time.Now().UTC(),
+				KeySalt:             keySalt,
+				KeyVerificationHash: keyVerificationHash,
+			})
+			if err != nil {
+				return err
+			}
+
+			c.Header("Content-Type", "application/json")
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="vibedtracker-vault-%s.json"`, time.Now().Format("2006-01-02")))
+			c.Status(http.StatusOK)
+			started = true
+
+			// Open the items array in place of the header's closing brace
+			_, err = c.Writer.Write(append(header[:len(header)-1], `,"items":[`...))
+			return err
+		},
+		func(item models.VaultItem) error {
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if !first {
+				data = append([]byte{','}, data...)
+			}
+			first = false
+			_, err = c.Writer.Write(data)
+			return err
+		},
+	)
+	if err != nil {
+		if !started {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to export data"})
+			return
+		}
+		// The archive stays unterminated, so importing it fails instead of losing items
+		log.Printf("Vault export for user %s aborted: %v", userID, err)
+		c.Abort()
+		return
+	}
+
+	_, _ = c.Writer.Write([]byte("]}"))
+}
+
+// Import writes the items of a vault archive into the user's account
+func (h *SyncHandler) Import(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return
+	}
+
+	var req models.ImportRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := h.userDevice(c, userID, deviceID); !ok {
+		return
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = models.ImportModeMerge
+	}
+
+	var archive models.VaultArchive
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, h.cfg.MaxImportBytes)
+	if err := json.NewDecoder(body).Decode(&archive); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "archive too large", "code": "BODY_TOO_LARGE"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid archive", "code": "INVALID_ARCHIVE"})
+		return
+	}
+	if archive.Format != models.VaultArchiveFormat || archive.Version != models.VaultArchiveVersion {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported archive format or version", "code": "UNSUPPORTED_ARCHIVE"})
+		return
+	}
+	if len(archive.KeySalt) == 0 || len(archive.KeyVerificationHash) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "archive contains no key info", "code": "INVALID_ARCHIVE"})
+		return
+	}
+	for _, item := range archive.Items {
+		if item.DataType == "" || item.LocalID == "" || len(item.EncryptedBlob) == 0 || len(item.Nonce) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "archive contains incomplete items", "code": "INVALID_ARCHIVE"})
+			return
+		}
+	}
+
+	summary, err := h.sync.ImportVault(c.Request.Context(), userID, deviceID, &archive, mode)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrKeyMismatch):
+			c.JSON(http.StatusConflict, gin.H{"error": "archive was encrypted with a different key", "code": "KEY_MISMATCH"})
+		case errors.Is(err, repository.ErrRotationInProgress):
+			c.JSON(http.StatusLocked, gin.H{"error": "key rotation in progress", "code": "ROTATION_IN_PROGRESS"})
+		case errors.Is(err, repository.ErrPushRejected):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "archive contains items that cannot be stored", "code": "INVALID_ARCHIVE"})
+		case errors.Is(err, repository.ErrQuotaExceeded):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "storage quota exceeded", "code": "QUOTA_EXCEEDED"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to import archive"})
+		}
+		return
+	}
+
+	summary.Timestamp = time.Now().Unix()
+	c.JSON(http.StatusOK, summary)
+}
+
+// Log returns the sync activity of the account, newest first, e.g. to find
+// out which device pushed a deletion
+func (h *SyncHandler) Log(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.SyncLogRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter, err := syncLogFilter(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := listSyncLog(c.Request.Context(), h.sync, userID, filter, req.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get sync log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// LogDaily returns the sync log summed per day and action
+func (h *SyncHandler) LogDaily(c *gin.Context) {
+	userID, ok := approvedUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.SyncLogRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter, err := syncLogFilter(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	timeZone, err := syncLogTimeZone(req.TimeZone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	days, err := h.sync.SyncLogDaily(c.Request.Context(), userID, filter, timeZone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get sync log"})
+		return
+	}
+	if days == nil {
+		days = []models.SyncLogDay{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"days": days, "time_zone": timeZone})
+}
+
+// syncLogFilter validates the query of the sync log endpoints
+func syncLogFilter(req models.SyncLogRequest) (models.SyncLogFilter, error) {
+	filter := models.SyncLogFilter{
+		Action:   req.Action,
+		DataType: req.DataType,
+	}
+	if req.DeviceID != "" {
+		deviceID, err := uuid.Parse(req.DeviceID)
+		if err != nil {
+			return filter, errors.New("invalid device_id")
+		}
+		filter.DeviceID = &deviceID
+	}
+	if req.From > 0 {
+		from := time.Unix(req.From, 0)
+		filter.From = &from
+	}
+	if req.To > 0 {
+		to := time.Unix(req.To, 0)
+		filter.To = &to
+	}
+	if req.Cursor != "" {
+		before, id, err := decodeLogCursor(req.Cursor)
+		if err != nil {
+			return filter, err
+		}
+		filter.BeforeTime = &before
+		filter.BeforeID = id
+	}
+	return filter, nil
+}
+
+// syncLogTimeZone checks the zone days are grouped in; empty means UTC
+func syncLogTimeZone(name string) (string, error) {
+	if name == "" {
+		return "UTC", nil
+	}
+	// "Local" is Go's name for the server zone and unknown to PostgreSQL
+	if _, err := time.LoadLocation(name); err != nil || name == "Local" {
+		return "", errors.New("invalid tz")
+	}
+	return name, nil
+}
+
+// listSyncLog loads one page of the sync log and the cursor for the next one
+func listSyncLog(ctx context.Context, sync *repository.SyncRepository, userID uuid.UUID, filter models.SyncLogFilter, limit int) (*models.SyncLogResponse, error) {
+	if limit <= 0 {
+		limit = DefaultSyncLogLimit
+	}
+	if limit > MaxSyncLogLimit {
+		limit = MaxSyncLogLimit
+	}
+
+	// Fetch one more to know whether another page follows
+	entries, err := sync.ListSyncLog(ctx, userID, filter, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.SyncLogResponse{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.HasMore = true
+		last := page.Entries[limit-1]
+		page.NextCursor = encodeLogCursor(last.CreatedAt, last.ID)
+	}
+	if page.Entries == nil {
+		page.Entries = []models.SyncLog{}
+	}
+	return page, nil
+}
+
+// Events streams a "changed" Server-Sent Event whenever another device of the
+// user commits sync changes. Clients then pull from their cursor.
+func (h *SyncHandler) Events(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	isApproved, _ := c.Get("is_approved")
+	if !isApproved.(bool) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account not approved for sync", "code": "NOT_APPROVED"})
+		return
+	}
+
+	deviceID, err := uuid.Parse(c.Query("device_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+
+	streamSyncEvents(c, h.events, userID, deviceID)
+}
+
+// streamSyncEvents writes the user's sync events to c until the client
+// disconnects. Events caused by excludeDevice are not sent.
+func streamSyncEvents(c *gin.Context, events *repository.SyncEvents, userID, excludeDevice uuid.UUID) {
+	ch, unsubscribe := events.Subscribe(userID)
+	defer unsubscribe()
+
+	heartbeat := time.NewTicker(syncEventHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("ready", gin.H{"timestamp": time.Now().Unix()})
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-ch:
+			if event.DeviceID == excludeDevice {
+				return true
+			}
+			data := gin.H{"data_types": event.DataTypes}
+			if event.Seq > 0 {
+				data["cursor"] = encodeCursor(event.Seq)
+			}
+			c.SSEvent("changed", data)
+			return true
+		case <-heartbeat.C:
+			c.SSEvent("ping", gin.H{"timestamp": time.Now().Unix()})
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
 	})
 }
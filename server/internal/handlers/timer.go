@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/sprobst76/vibedtracker-server/internal/middleware"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+	"github.com/sprobst76/vibedtracker-server/internal/repository"
+)
+
+// TimerHandler exposes the cross-device running timer (active_sessions)
+type TimerHandler struct {
+	sessions *repository.ActiveSessionRepository
+	devices  *repository.DeviceRepository
+}
+
+func NewTimerHandler(sessions *repository.ActiveSessionRepository, devices *repository.DeviceRepository) *TimerHandler {
+	return &TimerHandler{
+		sessions: sessions,
+		devices:  devices,
+	}
+}
+
+// Get returns the running timer, or null if none is running
+func (h *TimerHandler) Get(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	getTimer(c, h.sessions, userID)
+}
+
+// Start starts the timer for a work entry
+func (h *TimerHandler) Start(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var req models.StartTimerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := userDevice(c, h.devices, userID, deviceID); !ok {
+		return
+	}
+
+	startTimer(c, h.sessions, userID, deviceID, &req)
+}
+
+// Stop stops the running timer
+func (h *TimerHandler) Stop(c *gin.Context) {
+	userID, err := middleware.GetUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var req models.StopTimerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceID, err := uuid.Parse(req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+		return
+	}
+	if _, ok := userDevice(c, h.devices, userID, deviceID); !ok {
+		return
+	}
+
+	stopTimer(c, h.sessions, userID, deviceID, req.WorkEntryLocalID)
+}
+
+// The helpers below are shared with the web frontend, which identifies the
+// device through its session instead of the request body.
+
+func getTimer(c *gin.Context, sessions *repository.ActiveSessionRepository, userID uuid.UUID) {
+	session, err := sessions.Get(c.Request.Context(), userID)
+	if err != nil && !errors.Is(err, repository.ErrActiveSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get timer"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"active_session": session})
+}
+
+func startTimer(c *gin.Context, sessions *repository.ActiveSessionRepository, userID, deviceID uuid.UUID, req *models.StartTimerRequest) {
+	startedAt := time.Now()
+	if req.StartedAt > 0 {
+		startedAt = time.Unix(req.StartedAt, 0)
+	}
+
+	session, err := sessions.Start(c.Request.Context(), userID, deviceID, req.WorkEntryLocalID, startedAt, req.Force)
+	if err != nil {
+		if errors.Is(err, repository.ErrActiveSessionConflict) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":          "a timer is already running on another device",
+				"code":           "TIMER_RUNNING",
+				"active_session": session,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start timer"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"active_session": session})
+}
+
+func stopTimer(c *gin.Context, sessions *repository.ActiveSessionRepository, userID, deviceID uuid.UUID, localID string) {
+	session, err := sessions.Stop(c.Request.Context(), userID, deviceID, localID)
+	if err != nil {
+		if errors.Is(err, repository.ErrActiveSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no running timer"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to stop timer"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"stopped_session": session})
+}
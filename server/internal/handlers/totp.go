@@ -241,16 +241,16 @@ func (h *TOTPHandler) Validate(c *gin.Context) {
 	h.totpRepo.DeleteTempToken(req.TempToken)
 
 	// Generate access and refresh tokens
-	accessToken, err := middleware.GenerateAccessToken(user.ID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
+	refreshToken := middleware.GenerateRefreshToken()
+	session, err := h.tokens.Create(c.Request.Context(), user.ID, tempToken.DeviceID, refreshToken, time.Now().Add(h.cfg.RefreshExpiry), middleware.SessionClient(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
 		return
 	}
 
-	refreshToken := middleware.GenerateRefreshToken()
-	_, err = h.tokens.Create(c.Request.Context(), user.ID, tempToken.DeviceID, refreshToken, time.Now().Add(h.cfg.RefreshExpiry))
+	accessToken, err := middleware.GenerateAccessToken(user.ID, session.FamilyID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
@@ -298,16 +298,16 @@ func (h *TOTPHandler) ValidateRecovery(c *gin.Context) {
 	h.totpRepo.DeleteTempToken(req.TempToken)
 
 	// Generate access and refresh tokens
-	accessToken, err := middleware.GenerateAccessToken(user.ID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
+	refreshToken := middleware.GenerateRefreshToken()
+	session, err := h.tokens.Create(c.Request.Context(), user.ID, tempToken.DeviceID, refreshToken, time.Now().Add(h.cfg.RefreshExpiry), middleware.SessionClient(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
 		return
 	}
 
-	refreshToken := middleware.GenerateRefreshToken()
-	_, err = h.tokens.Create(c.Request.Context(), user.ID, tempToken.DeviceID, refreshToken, time.Now().Add(h.cfg.RefreshExpiry))
+	accessToken, err := middleware.GenerateAccessToken(user.ID, session.FamilyID, user.Email, user.IsAdmin, user.IsApproved, h.cfg.JWTExpiry)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
@@ -17,6 +18,8 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/sprobst76/vibedtracker-server/internal/config"
+	"github.com/sprobst76/vibedtracker-server/internal/mail"
+	"github.com/sprobst76/vibedtracker-server/internal/middleware"
 	"github.com/sprobst76/vibedtracker-server/internal/models"
 	"github.com/sprobst76/vibedtracker-server/internal/repository"
 )
@@ -30,6 +33,11 @@ type WebHandler struct {
 	syncRepo                *repository.SyncRepository
 	deviceRepo              *repository.DeviceRepository
 	passphraseRecoveryRepo  *repository.PassphraseRecoveryRepository
+	syncEvents              *repository.SyncEvents
+	activeSessionRepo       *repository.ActiveSessionRepository
+	verificationRepo        *repository.EmailVerificationRepository
+	passwordResetRepo       *repository.PasswordResetRepository
+	mailer                  mail.Mailer
 }
 
 func NewWebHandler(
@@ -40,11 +48,18 @@ func NewWebHandler(
 	syncRepo *repository.SyncRepository,
 	deviceRepo *repository.DeviceRepository,
 	passphraseRecoveryRepo *repository.PassphraseRecoveryRepository,
+	syncEvents *repository.SyncEvents,
+	activeSessionRepo *repository.ActiveSessionRepository,
+	verificationRepo *repository.EmailVerificationRepository,
+	passwordResetRepo *repository.PasswordResetRepository,
+	mailer mail.Mailer,
 ) *WebHandler {
 	// Custom template functions
 	funcMap := template.FuncMap{
 		"upper": strings.ToUpper,
 		"lower": strings.ToLower,
+		"bytes": formatBytes,
+		"syncAction": syncActionLabel,
 	}
 
 	// Collect all template files
@@ -95,6 +110,11 @@ func NewWebHandler(
 		syncRepo:               syncRepo,
 		deviceRepo:             deviceRepo,
 		passphraseRecoveryRepo: passphraseRecoveryRepo,
+		syncEvents:             syncEvents,
+		activeSessionRepo:      activeSessionRepo,
+		verificationRepo:       verificationRepo,
+		passwordResetRepo:      passwordResetRepo,
+		mailer:                 mailer,
 	}
 }
 
@@ -103,6 +123,109 @@ func (h *WebHandler) LoginPage(c *gin.Context) {
 	h.renderTemplate(c, "login.html", gin.H{})
 }
 
+// VerifyEmail confirms an email address from the link in the verification mail
+func (h *WebHandler) VerifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		h.renderTemplate(c, "login.html", gin.H{"Error": "Ungültiger Bestätigungslink"})
+		return
+	}
+
+	if _, err := h.verificationRepo.Verify(c.Request.Context(), token); err != nil {
+		if errors.Is(err, repository.ErrVerificationTokenInvalid) {
+			h.renderTemplate(c, "login.html", gin.H{"Error": "Der Bestätigungslink ist ungültig oder abgelaufen"})
+			return
+		}
+		h.renderTemplate(c, "login.html", gin.H{"Error": "E-Mail-Adresse konnte nicht bestätigt werden"})
+		return
+	}
+
+	h.renderTemplate(c, "login.html", gin.H{"Notice": "E-Mail-Adresse bestätigt. Du kannst dich anmelden, sobald dein Konto freigeschaltet ist."})
+}
+
+// ForgotPasswordPage renders the form to request a password reset mail
+func (h *WebHandler) ForgotPasswordPage(c *gin.Context) {
+	h.renderTemplate(c, "password-reset.html", gin.H{})
+}
+
+// ForgotPassword mails a reset link. The page looks the same for unknown
+// addresses.
+func (h *WebHandler) ForgotPassword(c *gin.Context) {
+	email := strings.ToLower(strings.TrimSpace(c.PostForm("email")))
+	if email == "" {
+		h.renderTemplate(c, "password-reset.html", gin.H{"Error": "E-Mail ist erforderlich"})
+		return
+	}
+
+	user, err := h.userRepo.GetByEmail(c.Request.Context(), email)
+	if err == nil && !user.IsBlocked {
+		if err := sendPasswordResetMail(c, h.cfg, h.passwordResetRepo, h.mailer, user.ID, user.Email); err != nil && !errors.Is(err, repository.ErrTooManyPasswordResets) {
+			log.Printf("Failed to send password reset mail to user %s: %v", user.ID, err)
+		}
+	} else if err != nil && !errors.Is(err, repository.ErrUserNotFound) {
+		h.renderTemplate(c, "password-reset.html", gin.H{"Error": "Fehler beim Senden der E-Mail", "Email": email})
+		return
+	}
+
+	h.renderTemplate(c, "password-reset.html", gin.H{
+		"Notice": "Falls die Adresse registriert ist, haben wir dir einen Link zum Zurücksetzen geschickt. Er ist 1 Stunde gültig.",
+	})
+}
+
+// ResetPasswordPage renders the form to set a new password from the link in
+// the reset mail
+func (h *WebHandler) ResetPasswordPage(c *gin.Context) {
+	token := c.Query("token")
+	valid := false
+	if token != "" {
+		var err error
+		if valid, err = h.passwordResetRepo.Valid(c.Request.Context(), token); err != nil {
+			c.String(http.StatusInternalServerError, "Fehler beim Prüfen des Links")
+			return
+		}
+	}
+	if !valid {
+		h.renderTemplate(c, "password-reset.html", gin.H{"Error": "Der Link ist ungültig, wurde bereits verwendet oder ist abgelaufen. Fordere einen neuen an."})
+		return
+	}
+
+	h.renderTemplate(c, "password-reset.html", gin.H{"Token": token})
+}
+
+// ResetPassword sets the new password and logs out all devices
+func (h *WebHandler) ResetPassword(c *gin.Context) {
+	token := c.PostForm("token")
+	password := c.PostForm("password")
+
+	if err := checkPasswordPolicy(password, ""); err != nil {
+		h.renderTemplate(c, "password-reset.html", gin.H{"Token": token, "Error": passwordPolicyMessage(err)})
+		return
+	}
+	if password != c.PostForm("password_confirm") {
+		h.renderTemplate(c, "password-reset.html", gin.H{"Token": token, "Error": "Die Passwörter stimmen nicht überein"})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		h.renderTemplate(c, "password-reset.html", gin.H{"Token": token, "Error": "Fehler beim Speichern des Passworts"})
+		return
+	}
+
+	if _, err := h.passwordResetRepo.Reset(c.Request.Context(), token, string(hash)); err != nil {
+		if errors.Is(err, repository.ErrResetTokenInvalid) {
+			h.renderTemplate(c, "password-reset.html", gin.H{"Error": "Der Link ist ungültig, wurde bereits verwendet oder ist abgelaufen. Fordere einen neuen an."})
+			return
+		}
+		h.renderTemplate(c, "password-reset.html", gin.H{"Token": token, "Error": "Fehler beim Speichern des Passworts"})
+		return
+	}
+
+	h.renderTemplate(c, "login.html", gin.H{
+		"Notice": "Passwort geändert, alle Geräte wurden abgemeldet. Deine Verschlüsselungs-Passphrase ist unverändert.",
+	})
+}
+
 // Login handles login form submission
 func (h *WebHandler) Login(c *gin.Context) {
 	email := strings.ToLower(strings.TrimSpace(c.PostForm("email")))
@@ -155,12 +278,8 @@ func (h *WebHandler) Login(c *gin.Context) {
 
 	// Check if TOTP is enabled
 	if user.TOTPEnabled {
-		// Generate temp token for TOTP verification
-		// We need a device ID - create a web device
-		device, err := h.deviceRepo.Create(c.Request.Context(), user.ID, &models.RegisterDeviceRequest{
-			DeviceName: "Web Browser",
-			DeviceType: "web",
-		})
+		// Generate temp token for TOTP verification, bound to the web device
+		device, err := h.deviceRepo.GetOrCreateWebDevice(c.Request.Context(), user.ID)
 		if err != nil {
 			h.renderFormOrFull(c, "login-form.html", "login.html", gin.H{
 				"Error": "Fehler beim Anmelden",
@@ -289,38 +408,89 @@ func (h *WebHandler) GetEncryptedData(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 	dataType := c.Query("type")
 	if dataType == "" {
-		dataType = "work_entry" // Default to work entries
+		dataType = models.DataTypeWorkEntry // Default to work entries
+	}
+	if _, ok := models.LookupDataType(dataType); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unbekannter Datentyp"})
+		return
 	}
 
-	// Get all items (since epoch)
-	items, err := h.syncRepo.PullItems(c.Request.Context(), userID.(uuid.UUID), time.Unix(0, 0), dataType)
+	// Get all non-deleted items
+	activeItems, err := h.syncRepo.ListActiveItems(c.Request.Context(), userID.(uuid.UUID), dataType)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data"})
 		return
 	}
 
-	// Filter out deleted items
-	var activeItems []models.SyncPullItem
-	for _, item := range items {
-		if !item.Deleted {
-			activeItems = append(activeItems, item)
-		}
-	}
-
 	c.JSON(http.StatusOK, gin.H{
 		"items": activeItems,
 		"count": len(activeItems),
 	})
 }
 
+// SyncEvents streams sync change notifications to the browser (Server-Sent
+// Events). Changes of the web device are not filtered out: all browsers of a
+// user share that device, so they would miss each other's changes.
+func (h *WebHandler) SyncEvents(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	streamSyncEvents(c, h.syncEvents, userID.(uuid.UUID), uuid.Nil)
+}
+
+// GetTimer returns the running timer (possibly started on another device)
+func (h *WebHandler) GetTimer(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	getTimer(c, h.activeSessionRepo, userID.(uuid.UUID))
+}
+
+// StartTimer starts the timer for a work entry from the browser
+func (h *WebHandler) StartTimer(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	deviceID, _ := c.Get("device_id")
+
+	var req struct {
+		WorkEntryLocalID string `json:"work_entry_local_id" binding:"required"`
+		StartedAt        int64  `json:"started_at"`
+		Force            bool   `json:"force"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	startTimer(c, h.activeSessionRepo, userID.(uuid.UUID), deviceID.(uuid.UUID), &models.StartTimerRequest{
+		WorkEntryLocalID: req.WorkEntryLocalID,
+		StartedAt:        req.StartedAt,
+		Force:            req.Force,
+	})
+}
+
+// StopTimer stops the running timer from the browser
+func (h *WebHandler) StopTimer(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	deviceID, _ := c.Get("device_id")
+
+	var req struct {
+		WorkEntryLocalID string `json:"work_entry_local_id"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	stopTimer(c, h.activeSessionRepo, userID.(uuid.UUID), deviceID.(uuid.UUID), req.WorkEntryLocalID)
+}
+
 // SaveEncryptedEntry saves a new or updated encrypted entry
 func (h *WebHandler) SaveEncryptedEntry(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	deviceID, _ := c.Get("device_id")
 
 	var req struct {
 		LocalID       string `json:"local_id" binding:"required"`
-		EncryptedBlob string `json:"encrypted_blob" binding:"required"`
-		Nonce         string `json:"nonce" binding:"required"`
+		EncryptedBlob []byte `json:"encrypted_blob" binding:"required"` // Base64
+		Nonce         []byte `json:"nonce" binding:"required"`          // Base64
 		DataType      string `json:"data_type"`
 	}
 
@@ -330,17 +500,7 @@ func (h *WebHandler) SaveEncryptedEntry(c *gin.Context) {
 	}
 
 	if req.DataType == "" {
-		req.DataType = "work_entry"
-	}
-
-	// Create a web device ID for this operation
-	device, err := h.deviceRepo.Create(c.Request.Context(), userID.(uuid.UUID), &models.RegisterDeviceRequest{
-		DeviceName: "Web Browser",
-		DeviceType: "web",
-	})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get device"})
-		return
+		req.DataType = models.DataTypeWorkEntry
 	}
 
 	// Push the item
@@ -353,7 +513,19 @@ func (h *WebHandler) SaveEncryptedEntry(c *gin.Context) {
 		Deleted:       false,
 	}}
 
-	if err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), device.ID, items); err != nil {
+	if results, err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), deviceID.(uuid.UUID), items); err != nil {
+		if errors.Is(err, repository.ErrPushRejected) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": results[0].Error, "code": "PUSH_REJECTED"})
+			return
+		}
+		if errors.Is(err, repository.ErrQuotaExceeded) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Speicherplatz-Kontingent überschritten", "code": "QUOTA_EXCEEDED"})
+			return
+		}
+		if errors.Is(err, repository.ErrRotationInProgress) {
+			c.JSON(http.StatusLocked, gin.H{"error": "Schlüsselwechsel läuft, bitte später erneut versuchen", "code": "ROTATION_IN_PROGRESS"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save entry"})
 		return
 	}
@@ -367,6 +539,7 @@ func (h *WebHandler) SaveEncryptedEntry(c *gin.Context) {
 // DeleteEncryptedEntry soft-deletes an encrypted entry
 func (h *WebHandler) DeleteEncryptedEntry(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	deviceID, _ := c.Get("device_id")
 	localID := c.Param("id")
 
 	if localID == "" {
@@ -374,27 +547,21 @@ func (h *WebHandler) DeleteEncryptedEntry(c *gin.Context) {
 		return
 	}
 
-	// Create a web device ID for this operation
-	device, err := h.deviceRepo.Create(c.Request.Context(), userID.(uuid.UUID), &models.RegisterDeviceRequest{
-		DeviceName: "Web Browser",
-		DeviceType: "web",
-	})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get device"})
-		return
-	}
-
 	// Push a delete operation (we need to provide dummy encrypted data for soft delete)
 	items := []models.SyncPushItem{{
-		DataType:      "work_entry",
+		DataType:      models.DataTypeWorkEntry,
 		LocalID:       localID,
-		EncryptedBlob: "", // Empty for delete
-		Nonce:         "",
+		EncryptedBlob: nil, // Empty for delete
+		Nonce:         nil,
 		SchemaVersion: 1,
 		Deleted:       true,
 	}}
 
-	if err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), device.ID, items); err != nil {
+	if _, err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), deviceID.(uuid.UUID), items); err != nil {
+		if errors.Is(err, repository.ErrRotationInProgress) {
+			c.JSON(http.StatusLocked, gin.H{"error": "Schlüsselwechsel läuft, bitte später erneut versuchen", "code": "ROTATION_IN_PROGRESS"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete entry"})
 		return
 	}
@@ -407,6 +574,13 @@ func (h *WebHandler) DeleteEncryptedEntry(c *gin.Context) {
 
 // Logout handles logout
 func (h *WebHandler) Logout(c *gin.Context) {
+	// End the session so it no longer shows up as active
+	userID, _ := c.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+	if err := h.tokenRepo.RevokeSession(c.Request.Context(), userID.(uuid.UUID), sessionID.(uuid.UUID)); err != nil && !errors.Is(err, repository.ErrTokenNotFound) {
+		log.Printf("Failed to revoke web session: %v", err)
+	}
+
 	// Clear session cookie
 	c.SetCookie("session", "", -1, "/", "", true, true)
 	c.Redirect(http.StatusSeeOther, "/web/login")
@@ -421,11 +595,8 @@ func generateSessionToken() string {
 
 // createSessionAndRedirect creates a session cookie and redirects to dashboard
 func (h *WebHandler) createSessionAndRedirect(c *gin.Context, userID uuid.UUID, email string) {
-	// Create or get a web device for this user
-	device, err := h.deviceRepo.Create(c.Request.Context(), userID, &models.RegisterDeviceRequest{
-		DeviceName: "Web Browser",
-		DeviceType: "web",
-	})
+	// All sessions of a user sync as the same web device
+	device, err := h.deviceRepo.GetOrCreateWebDevice(c.Request.Context(), userID)
 	if err != nil {
 		h.renderTemplate(c, "login.html", gin.H{
 			"Error": "Fehler beim Erstellen der Sitzung",
@@ -437,7 +608,7 @@ func (h *WebHandler) createSessionAndRedirect(c *gin.Context, userID uuid.UUID,
 	sessionToken := generateSessionToken()
 
 	// Store in database
-	_, err = h.tokenRepo.Create(c.Request.Context(), userID, device.ID, sessionToken, time.Now().Add(24*time.Hour))
+	_, err = h.tokenRepo.Create(c.Request.Context(), userID, device.ID, sessionToken, time.Now().Add(24*time.Hour), middleware.SessionClient(c))
 	if err != nil {
 		h.renderTemplate(c, "login.html", gin.H{
 			"Error": "Fehler beim Erstellen der Sitzung",
@@ -515,7 +686,8 @@ func (h *WebHandler) AdminUsers(c *gin.Context) {
 		return
 	}
 	h.renderTemplate(c, "admin-users.html", gin.H{
-		"Users": users,
+		"Users":                    users,
+		"RequireEmailVerification": h.cfg.RequireEmailVerification,
 	})
 }
 
@@ -528,6 +700,18 @@ func (h *WebHandler) AdminApproveUser(c *gin.Context) {
 		return
 	}
 
+	if h.cfg.RequireEmailVerification {
+		user, err := h.userRepo.GetByID(c.Request.Context(), id)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Error loading user")
+			return
+		}
+		if !user.EmailVerified {
+			c.String(http.StatusConflict, "E-Mail-Adresse noch nicht bestätigt")
+			return
+		}
+	}
+
 	if err := h.userRepo.Approve(c.Request.Context(), id); err != nil {
 		c.String(http.StatusInternalServerError, "Error approving user")
 		return
@@ -540,13 +724,16 @@ func (h *WebHandler) AdminApproveUser(c *gin.Context) {
 		return
 	}
 	h.renderTemplate(c, "admin-user-row.html", gin.H{
-		"ID":          user.ID,
-		"Email":       user.Email,
-		"IsApproved":  user.IsApproved,
-		"IsAdmin":     user.IsAdmin,
-		"IsBlocked":   user.IsBlocked,
-		"TOTPEnabled": user.TOTPEnabled,
-		"CreatedAt":   user.CreatedAt,
+		"ID":            user.ID,
+		"Email":         user.Email,
+		"IsApproved":    user.IsApproved,
+		"IsAdmin":       user.IsAdmin,
+		"IsBlocked":     user.IsBlocked,
+		"TOTPEnabled":   user.TOTPEnabled,
+		"CreatedAt":     user.CreatedAt,
+		"EmailVerified": user.EmailVerified,
+
+		"RequireEmailVerification": h.cfg.RequireEmailVerification,
 	})
 }
 
@@ -576,13 +763,16 @@ func (h *WebHandler) AdminBlockUser(c *gin.Context) {
 		return
 	}
 	h.renderTemplate(c, "admin-user-row.html", gin.H{
-		"ID":          user.ID,
-		"Email":       user.Email,
-		"IsApproved":  user.IsApproved,
-		"IsAdmin":     user.IsAdmin,
-		"IsBlocked":   user.IsBlocked,
-		"TOTPEnabled": user.TOTPEnabled,
-		"CreatedAt":   user.CreatedAt,
+		"ID":            user.ID,
+		"Email":         user.Email,
+		"IsApproved":    user.IsApproved,
+		"IsAdmin":       user.IsAdmin,
+		"IsBlocked":     user.IsBlocked,
+		"TOTPEnabled":   user.TOTPEnabled,
+		"CreatedAt":     user.CreatedAt,
+		"EmailVerified": user.EmailVerified,
+
+		"RequireEmailVerification": h.cfg.RequireEmailVerification,
 	})
 }
 
@@ -607,13 +797,16 @@ func (h *WebHandler) AdminUnblockUser(c *gin.Context) {
 		return
 	}
 	h.renderTemplate(c, "admin-user-row.html", gin.H{
-		"ID":          user.ID,
-		"Email":       user.Email,
-		"IsApproved":  user.IsApproved,
-		"IsAdmin":     user.IsAdmin,
-		"IsBlocked":   user.IsBlocked,
-		"TOTPEnabled": user.TOTPEnabled,
-		"CreatedAt":   user.CreatedAt,
+		"ID":            user.ID,
+		"Email":         user.Email,
+		"IsApproved":    user.IsApproved,
+		"IsAdmin":       user.IsAdmin,
+		"IsBlocked":     user.IsBlocked,
+		"TOTPEnabled":   user.TOTPEnabled,
+		"CreatedAt":     user.CreatedAt,
+		"EmailVerified": user.EmailVerified,
+
+		"RequireEmailVerification": h.cfg.RequireEmailVerification,
 	})
 }
 
@@ -656,8 +849,28 @@ func (h *WebHandler) AdminDevices(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Error loading devices")
 		return
 	}
+
+	ids := make([]uuid.UUID, len(devices))
+	for i := range devices {
+		ids[i] = devices[i].ID
+	}
+	health, err := h.deviceRepo.SyncHealth(c.Request.Context(), ids, h.cfg.StaleDeviceAfter)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading devices")
+		return
+	}
+	staleCount := 0
+	for i := range devices {
+		devices[i].SyncHealth = health[devices[i].ID]
+		if devices[i].SyncHealth != nil && devices[i].SyncHealth.Stale {
+			staleCount++
+		}
+	}
+
 	h.renderTemplate(c, "admin-devices.html", gin.H{
-		"Devices": devices,
+		"Devices":    devices,
+		"StaleCount": staleCount,
+		"StaleDays":  int(h.cfg.StaleDeviceAfter / (24 * time.Hour)),
 	})
 }
 
@@ -713,11 +926,12 @@ func (h *WebHandler) Vacation(c *gin.Context) {
 // SaveVacation saves a new or updated vacation entry
 func (h *WebHandler) SaveVacation(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	deviceID, _ := c.Get("device_id")
 
 	var req struct {
 		LocalID       string `json:"local_id" binding:"required"`
-		EncryptedBlob string `json:"encrypted_blob" binding:"required"`
-		Nonce         string `json:"nonce" binding:"required"`
+		EncryptedBlob []byte `json:"encrypted_blob" binding:"required"` // Base64
+		Nonce         []byte `json:"nonce" binding:"required"`          // Base64
 		DataType      string `json:"data_type"`
 	}
 
@@ -727,17 +941,7 @@ func (h *WebHandler) SaveVacation(c *gin.Context) {
 	}
 
 	if req.DataType == "" {
-		req.DataType = "vacation"
-	}
-
-	// Create a web device ID for this operation
-	device, err := h.deviceRepo.Create(c.Request.Context(), userID.(uuid.UUID), &models.RegisterDeviceRequest{
-		DeviceName: "Web Browser",
-		DeviceType: "web",
-	})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get device"})
-		return
+		req.DataType = models.DataTypeVacation
 	}
 
 	// Push the item
@@ -750,7 +954,19 @@ func (h *WebHandler) SaveVacation(c *gin.Context) {
 		Deleted:       false,
 	}}
 
-	if err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), device.ID, items); err != nil {
+	if results, err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), deviceID.(uuid.UUID), items); err != nil {
+		if errors.Is(err, repository.ErrPushRejected) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": results[0].Error, "code": "PUSH_REJECTED"})
+			return
+		}
+		if errors.Is(err, repository.ErrQuotaExceeded) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Speicherplatz-Kontingent überschritten", "code": "QUOTA_EXCEEDED"})
+			return
+		}
+		if errors.Is(err, repository.ErrRotationInProgress) {
+			c.JSON(http.StatusLocked, gin.H{"error": "Schlüsselwechsel läuft, bitte später erneut versuchen", "code": "ROTATION_IN_PROGRESS"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save vacation"})
 		return
 	}
@@ -764,6 +980,7 @@ func (h *WebHandler) SaveVacation(c *gin.Context) {
 // DeleteVacation soft-deletes a vacation entry
 func (h *WebHandler) DeleteVacation(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	deviceID, _ := c.Get("device_id")
 	localID := c.Param("id")
 
 	if localID == "" {
@@ -771,27 +988,21 @@ func (h *WebHandler) DeleteVacation(c *gin.Context) {
 		return
 	}
 
-	// Create a web device ID for this operation
-	device, err := h.deviceRepo.Create(c.Request.Context(), userID.(uuid.UUID), &models.RegisterDeviceRequest{
-		DeviceName: "Web Browser",
-		DeviceType: "web",
-	})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get device"})
-		return
-	}
-
 	// Push a delete operation
 	items := []models.SyncPushItem{{
-		DataType:      "vacation",
+		DataType:      models.DataTypeVacation,
 		LocalID:       localID,
-		EncryptedBlob: "",
-		Nonce:         "",
+		EncryptedBlob: nil,
+		Nonce:         nil,
 		SchemaVersion: 1,
 		Deleted:       true,
 	}}
 
-	if err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), device.ID, items); err != nil {
+	if _, err := h.syncRepo.PushItems(c.Request.Context(), userID.(uuid.UUID), deviceID.(uuid.UUID), items); err != nil {
+		if errors.Is(err, repository.ErrRotationInProgress) {
+			c.JSON(http.StatusLocked, gin.H{"error": "Schlüsselwechsel läuft, bitte später erneut versuchen", "code": "ROTATION_IN_PROGRESS"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete vacation"})
 		return
 	}
@@ -819,6 +1030,216 @@ func (h *WebHandler) Settings(c *gin.Context) {
 	})
 }
 
+// PasswordForm renders the form to change the password
+func (h *WebHandler) PasswordForm(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	user, err := h.userRepo.GetByID(c.Request.Context(), userID.(uuid.UUID))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Fehler beim Laden des Benutzers")
+		return
+	}
+
+	h.renderTemplate(c, "password-form.html", gin.H{
+		"TOTPEnabled": user.TOTPEnabled,
+	})
+}
+
+// ChangePassword sets a new password and logs out all other sessions
+func (h *WebHandler) ChangePassword(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+
+	user, err := h.userRepo.GetByID(c.Request.Context(), userID.(uuid.UUID))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Fehler beim Laden des Benutzers")
+		return
+	}
+
+	data := gin.H{"TOTPEnabled": user.TOTPEnabled}
+	req := models.ChangePasswordRequest{
+		CurrentPassword: c.PostForm("current_password"),
+		NewPassword:     c.PostForm("new_password"),
+		Code:            strings.TrimSpace(c.PostForm("code")),
+	}
+	if req.NewPassword != c.PostForm("new_password_confirm") {
+		data["Error"] = "Die Passwörter stimmen nicht überein"
+		h.renderTemplate(c, "password-form.html", data)
+		return
+	}
+
+	err = changePassword(c.Request.Context(), h.userRepo, h.tokenRepo, h.totpRepo, user, sessionID.(uuid.UUID), &req)
+	switch {
+	case err == nil:
+		data["Notice"] = "Passwort geändert. Alle anderen Sitzungen wurden abgemeldet."
+	case errors.Is(err, repository.ErrTooManyAttempts):
+		data["Error"] = "Zu viele Fehlversuche, bitte später erneut versuchen"
+	case errors.Is(err, errWrongPassword):
+		data["Error"] = "Aktuelles Passwort ist falsch"
+	case errors.Is(err, errTOTPCodeRequired):
+		data["Error"] = "Bitte gib deinen 2FA-Code ein"
+	case errors.Is(err, errWrongTOTPCode):
+		data["Error"] = "Ungültiger 2FA-Code"
+	case errors.Is(err, errPasswordUnchanged):
+		data["Error"] = "Das neue Passwort muss sich vom aktuellen unterscheiden"
+	case isPasswordPolicyError(err):
+		data["Error"] = passwordPolicyMessage(err)
+	default:
+		data["Error"] = "Fehler beim Speichern des Passworts"
+	}
+	h.renderTemplate(c, "password-form.html", data)
+}
+
+// syncLogSummaryDays is how far back the settings page sums the sync log
+const syncLogSummaryDays = 14
+
+// SyncLog renders the user's sync activity for the settings page. With a
+// cursor only the next rows are rendered ("Mehr laden").
+func (h *WebHandler) SyncLog(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.String(http.StatusUnauthorized, "Nicht angemeldet")
+		return
+	}
+	uid := userID.(uuid.UUID)
+
+	var req models.SyncLogRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.String(http.StatusBadRequest, "Ungültiger Filter")
+		return
+	}
+	filter, err := syncLogFilter(req)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Ungültiger Filter")
+		return
+	}
+
+	page, err := listSyncLog(c.Request.Context(), h.syncRepo, uid, filter, req.Limit)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Fehler beim Laden des Sync-Protokolls")
+		return
+	}
+	data := gin.H{
+		"Entries":    page.Entries,
+		"HasMore":    page.HasMore,
+		"NextCursor": page.NextCursor,
+		"Filter":     req,
+	}
+	if req.Cursor != "" {
+		h.renderTemplate(c, "sync-log-rows", data)
+		return
+	}
+
+	devices, err := h.deviceRepo.GetByUserID(c.Request.Context(), uid)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Fehler beim Laden des Sync-Protokolls")
+		return
+	}
+
+	summaryFilter := filter
+	since := time.Now().AddDate(0, 0, -syncLogSummaryDays)
+	summaryFilter.From = &since
+	days, err := h.syncRepo.SyncLogDaily(c.Request.Context(), uid, summaryFilter, serverTimeZone())
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Fehler beim Laden des Sync-Protokolls")
+		return
+	}
+
+	data["Devices"] = devices
+	data["Actions"] = []string{"push", "pull", "snapshot", "conflict", "import", "restore", "purge", "rotation_abort"}
+	data["Days"] = days
+	data["SummaryDays"] = syncLogSummaryDays
+	h.renderTemplate(c, "sync-log.html", data)
+}
+
+// Sessions renders the logins of the user for the settings page
+func (h *WebHandler) Sessions(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+
+	sessions, err := h.tokenRepo.ListSessions(c.Request.Context(), userID.(uuid.UUID))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Fehler beim Laden der Sitzungen")
+		return
+	}
+	markCurrentSession(sessions, sessionID.(uuid.UUID))
+
+	h.renderTemplate(c, "sessions.html", gin.H{
+		"Sessions": sessions,
+	})
+}
+
+// RevokeSession ends one session. Ending the own session logs out.
+func (h *WebHandler) RevokeSession(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Ungültige Sitzung")
+		return
+	}
+
+	if err := h.tokenRepo.RevokeSession(c.Request.Context(), userID.(uuid.UUID), id); err != nil {
+		if errors.Is(err, repository.ErrTokenNotFound) {
+			c.String(http.StatusNotFound, "Sitzung nicht gefunden")
+			return
+		}
+		c.String(http.StatusInternalServerError, "Fehler beim Abmelden der Sitzung")
+		return
+	}
+
+	if id == sessionID.(uuid.UUID) {
+		c.SetCookie("session", "", -1, "/", "", true, true)
+		c.Header("HX-Redirect", "/web/login")
+	}
+	c.Status(http.StatusOK)
+}
+
+// RevokeOtherSessions ends all sessions except the current one
+func (h *WebHandler) RevokeOtherSessions(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+
+	if _, err := h.tokenRepo.RevokeOtherSessions(c.Request.Context(), userID.(uuid.UUID), sessionID.(uuid.UUID)); err != nil {
+		c.String(http.StatusInternalServerError, "Fehler beim Abmelden der Sitzungen")
+		return
+	}
+
+	h.Sessions(c)
+}
+
+// serverTimeZone names the zone the web interface shows times in (TZ)
+func serverTimeZone() string {
+	if name := time.Local.String(); name != "Local" {
+		return name
+	}
+	return "UTC"
+}
+
+// syncActionLabel names a sync log action in the web interface
+func syncActionLabel(action string) string {
+	switch action {
+	case "push":
+		return "Hochgeladen"
+	case "pull":
+		return "Abgerufen"
+	case "snapshot":
+		return "Snapshot abgerufen"
+	case "conflict":
+		return "Konflikt"
+	case "import":
+		return "Import"
+	case "restore":
+		return "Wiederhergestellt"
+	case "purge":
+		return "Gelöschte bereinigt"
+	case "rotation_abort":
+		return "Schlüsselwechsel abgebrochen"
+	}
+	return action
+}
+
 // ============================================================
 // Passphrase Recovery Handler
 // ============================================================
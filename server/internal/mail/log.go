@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LogMailer doesn't deliver mail. It writes each message as .eml file into
+// a directory, or to the server log if no directory is set.
+type LogMailer struct {
+	dir  string
+	from string
+}
+
+func NewLogMailer(dir, from string) (*LogMailer, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &LogMailer{dir: dir, from: from}, nil
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	if !validHeader(msg.To) || !validHeader(msg.Subject) {
+		return ErrInvalidHeader
+	}
+
+	now := time.Now()
+	if m.dir == "" {
+		log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102-150405"), uuid.NewString()[:8])
+	return os.WriteFile(filepath.Join(m.dir, name), format(m.from, msg, now), 0o600)
+}
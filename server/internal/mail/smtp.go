@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTPMailer delivers mail through an SMTP server. Port 465 uses implicit
+// TLS, other ports STARTTLS when the server offers it. Credentials are only
+// sent over TLS.
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string // As written in the From: header, e.g. "Name <addr>"
+	envelope string // Bare address for MAIL FROM
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) (*SMTPMailer, error) {
+	addr, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, ErrInvalidAddress
+	}
+	return &SMTPMailer{host: host, port: port, username: username, password: password, from: from, envelope: addr.Address}, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if !validHeader(msg.To) || !validHeader(msg.Subject) {
+		return ErrInvalidHeader
+	}
+	// SMTP commands take the bare address, the display form stays in the header
+	to, err := netmail.ParseAddress(msg.To)
+	if err != nil {
+		return ErrInvalidAddress
+	}
+
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if m.port == 465 {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && m.port != 465 {
+		if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		// PlainAuth refuses to send credentials without TLS
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(m.envelope); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(format(m.from, msg, time.Now())); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -9,25 +9,32 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
 )
 
 type Claims struct {
 	UserID    string `json:"user_id"`
+	SessionID string `json:"sid,omitempty"` // Refresh token family the token was issued for
 	Email     string `json:"email"`
 	IsAdmin   bool   `json:"is_admin"`
 	IsApproved bool  `json:"is_approved"`
 	jwt.RegisteredClaims
 }
 
+// Longer user agents are cut when stored with a session
+const maxUserAgentLength = 512
+
 var jwtSecret []byte
 
 func SetJWTSecret(secret string) {
 	jwtSecret = []byte(secret)
 }
 
-func GenerateAccessToken(userID uuid.UUID, email string, isAdmin, isApproved bool, expiry time.Duration) (string, error) {
+func GenerateAccessToken(userID, sessionID uuid.UUID, email string, isAdmin, isApproved bool, expiry time.Duration) (string, error) {
 	claims := &Claims{
 		UserID:     userID.String(),
+		SessionID:  sessionID.String(),
 		Email:      email,
 		IsAdmin:    isAdmin,
 		IsApproved: isApproved,
@@ -77,6 +84,7 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		// Store claims in context
 		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
 		c.Set("email", claims.Email)
 		c.Set("is_admin", claims.IsAdmin)
 		c.Set("is_approved", claims.IsApproved)
@@ -114,3 +122,22 @@ func GetUserID(c *gin.Context) (uuid.UUID, error) {
 	}
 	return uuid.Parse(userIDStr.(string))
 }
+
+// GetSessionID returns the session the access token was issued for. Tokens
+// issued before sessions were tracked don't name one.
+func GetSessionID(c *gin.Context) (uuid.UUID, error) {
+	sessionIDStr, exists := c.Get("session_id")
+	if !exists {
+		return uuid.Nil, errors.New("session_id not found in context")
+	}
+	return uuid.Parse(sessionIDStr.(string))
+}
+
+// SessionClient describes the client of a request for the session list
+func SessionClient(c *gin.Context) models.SessionClient {
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return models.SessionClient{IPAddress: c.ClientIP(), UserAgent: userAgent}
+}
@@ -1,12 +1,17 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sprobst76/vibedtracker-server/internal/repository"
 )
 
+// sessionTouchInterval limits how often a web session's last use is written
+const sessionTouchInterval = 5 * time.Minute
+
 // WebAuthMiddleware checks for a valid session cookie
 func WebAuthMiddleware(tokenRepo *repository.TokenRepository, userRepo *repository.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -48,6 +53,15 @@ func WebAuthMiddleware(tokenRepo *repository.TokenRepository, userRepo *reposito
 		c.Set("user_id", user.ID)
 		c.Set("user_email", user.Email)
 		c.Set("user_is_admin", user.IsAdmin)
+		c.Set("device_id", token.DeviceID)
+		c.Set("session_id", token.FamilyID)
+
+		// Web sessions aren't rotated, so their last use is recorded here
+		if time.Since(token.LastUsedAt) > sessionTouchInterval {
+			if err := tokenRepo.Touch(c.Request.Context(), token.ID, SessionClient(c)); err != nil {
+				log.Printf("Failed to record session use: %v", err)
+			}
+		}
 
 		c.Next()
 	}
@@ -0,0 +1,68 @@
+package models
+
+// Sync data types. Items of other types are rejected on push, so a typo in a
+// client cannot create an orphan category.
+const (
+	DataTypeWorkEntry         = "work_entry"
+	DataTypeVacation          = "vacation"
+	DataTypeVacationQuota     = "vacation_quota"
+	DataTypeProject           = "project"
+	DataTypeSettings          = "settings"
+	DataTypePause             = "pause"
+	DataTypeGeofenceZone      = "geofence_zone"
+	DataTypeWeeklyHoursPeriod = "weekly_hours_period"
+	DataTypeWorkException     = "work_exception"
+	DataTypePomodoroSession   = "pomodoro_session"
+	DataTypeUserSettings      = "user_settings" // Stored by the web settings page (templates/settings.html)
+)
+
+// DataTypeSpec describes a data type the server accepts and its limits
+type DataTypeSpec struct {
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	MaxItems     int    `json:"max_items,omitempty"`      // Live items per user, 0 = unlimited
+	MaxBlobBytes int    `json:"max_blob_bytes,omitempty"` // 0 = server default
+	Singleton    bool   `json:"singleton,omitempty"`      // At most one live item per user
+}
+
+// DataTypes is the registry of sync data types
+var DataTypes = []DataTypeSpec{
+	{Name: DataTypeWorkEntry, Description: "Arbeitszeiteintrag", MaxBlobBytes: 64 << 10},
+	{Name: DataTypeVacation, Description: "Urlaub und Abwesenheit", MaxBlobBytes: 16 << 10},
+	{Name: DataTypeVacationQuota, Description: "Urlaubskontingent eines Jahres", MaxItems: 200, MaxBlobBytes: 16 << 10},
+	{Name: DataTypeProject, Description: "Projekt", MaxItems: 1000, MaxBlobBytes: 16 << 10},
+	{Name: DataTypeSettings, Description: "App-Einstellungen", MaxBlobBytes: 256 << 10, Singleton: true},
+	{Name: DataTypePause, Description: "Pause innerhalb eines Arbeitszeiteintrags", MaxBlobBytes: 16 << 10},
+	{Name: DataTypeGeofenceZone, Description: "Geofence-Zone für automatisches Ein-/Ausstempeln", MaxItems: 100, MaxBlobBytes: 16 << 10},
+	{Name: DataTypeWeeklyHoursPeriod, Description: "Zeitraum mit vereinbarter Wochenarbeitszeit", MaxItems: 500, MaxBlobBytes: 16 << 10},
+	{Name: DataTypeWorkException, Description: "Abweichender Arbeitstag (z.B. Feiertag, halber Tag)", MaxBlobBytes: 16 << 10},
+	{Name: DataTypePomodoroSession, Description: "Pomodoro-Sitzung", MaxBlobBytes: 16 << 10},
+	{Name: DataTypeUserSettings, Description: "Einstellungen der Web-Oberfläche", MaxBlobBytes: 256 << 10, Singleton: true},
+}
+
+// LookupDataType returns the spec of a registered data type
+func LookupDataType(name string) (DataTypeSpec, bool) {
+	for _, spec := range DataTypes {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return DataTypeSpec{}, false
+}
+
+// ItemLimit is the maximum number of live items per user, 0 = unlimited
+func (d DataTypeSpec) ItemLimit() int {
+	if d.Singleton {
+		return 1
+	}
+	return d.MaxItems
+}
+
+// BlobLimit is the maximum blob size, taking the server-wide maximum
+// (0 = unlimited) into account
+func (d DataTypeSpec) BlobLimit(serverMax int) int {
+	if d.MaxBlobBytes == 0 || (serverMax > 0 && serverMax < d.MaxBlobBytes) {
+		return serverMax
+	}
+	return d.MaxBlobBytes
+}
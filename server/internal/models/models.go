@@ -11,6 +11,7 @@ type User struct {
 	ID                  uuid.UUID  `json:"id"`
 	Email               string     `json:"email"`
 	PasswordHash        string     `json:"-"`
+	EmailVerified       bool       `json:"email_verified"`
 	IsApproved          bool       `json:"is_approved"`
 	IsAdmin             bool       `json:"is_admin"`
 	IsBlocked           bool       `json:"is_blocked"`
@@ -25,15 +26,36 @@ type User struct {
 
 // Device represents a registered app instance
 type Device struct {
-	ID          uuid.UUID  `json:"id"`
-	UserID      uuid.UUID  `json:"user_id"`
-	DeviceName  string     `json:"device_name"`
-	DeviceType  string     `json:"device_type"`
-	DeviceModel string     `json:"device_model,omitempty"`
-	AppVersion  string     `json:"app_version,omitempty"`
-	LastSync    *time.Time `json:"last_sync,omitempty"`
-	CreatedAt   time.Time  `json:"created_at"`
-	UpdatedAt   time.Time  `json:"updated_at"`
+	ID             uuid.UUID      `json:"id"`
+	UserID         uuid.UUID      `json:"user_id"`
+	DeviceName     string         `json:"device_name"`
+	DeviceType     string         `json:"device_type"`
+	DeviceModel    string         `json:"device_model,omitempty"`
+	AppVersion     string         `json:"app_version,omitempty"`
+	SchemaVersions map[string]int `json:"schema_versions,omitempty"` // Highest schema_version per data_type the device can decode
+	LastSync       *time.Time     `json:"last_sync,omitempty"`
+	TokenReuseAt   *time.Time     `json:"token_reuse_at,omitempty"` // A rotated refresh token was presented again
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	// Only filled for device listings
+	SyncHealth *DeviceSyncHealth `json:"sync_health,omitempty"`
+}
+
+// The web interface syncs as one device per user, created at the first login
+const (
+	WebDeviceName = "Web Browser"
+	WebDeviceType = "web"
+)
+
+// AllDataTypes is the cursor key for pulls without data_type filter
+const AllDataTypes = "*"
+
+// DeviceSyncHealth tells how far behind a device is
+type DeviceSyncHealth struct {
+	Cursors        map[string]int64 `json:"cursors"`         // Last acknowledged seq per data_type
+	PendingChanges int              `json:"pending_changes"` // Changes of other devices not yet acknowledged
+	DaysSinceSync  int              `json:"days_since_sync"` // Since registration if never synced
+	Stale          bool             `json:"stale"`
 }
 
 // EncryptedData represents a zero-knowledge encrypted blob
@@ -51,25 +73,77 @@ type EncryptedData struct {
 	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
 }
 
+// ActiveSession is the running timer of a user, shared across devices
+type ActiveSession struct {
+	ID               uuid.UUID  `json:"id"`
+	UserID           uuid.UUID  `json:"user_id"`
+	DeviceID         *uuid.UUID `json:"device_id,omitempty"`
+	WorkEntryLocalID string     `json:"work_entry_local_id"`
+	StartedAt        time.Time  `json:"started_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// IdempotencyRecord is a stored response for a request with an Idempotency-Key
+type IdempotencyRecord struct {
+	UserID      uuid.UUID
+	Key         string
+	RequestHash string
+	StatusCode  *int // nil while the original request is still running
+	ContentType string
+	Response    []byte
+	CreatedAt   time.Time
+}
+
 // RefreshToken for JWT refresh
 type RefreshToken struct {
-	ID        uuid.UUID `json:"id"`
-	UserID    uuid.UUID `json:"user_id"`
-	DeviceID  uuid.UUID `json:"device_id"`
-	TokenHash string    `json:"-"`
-	ExpiresAt time.Time `json:"expires_at"`
-	Revoked   bool      `json:"revoked"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uuid.UUID  `json:"id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	DeviceID  uuid.UUID  `json:"device_id"`
+	FamilyID  uuid.UUID  `json:"family_id"` // Tokens rotated from the same login
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Revoked   bool       `json:"revoked"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"` // Exchanged for a successor
+	SessionClient
+	SessionCreatedAt time.Time `json:"session_created_at"` // Login the family started with
+	LastUsedAt       time.Time `json:"last_used_at"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// SessionClient tells where a session was last used from
+type SessionClient struct {
+	IPAddress string `json:"ip_address,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// Session is a login of a user, i.e. a live refresh token family
+type Session struct {
+	ID         uuid.UUID `json:"id"` // Token family, stays the same across refreshes
+	DeviceID   uuid.UUID `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	DeviceType string    `json:"device_type"`
+	SessionClient
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"` // The session of the request
 }
 
 // SyncLog for audit trail
 type SyncLog struct {
 	ID         uuid.UUID  `json:"id"`
 	UserID     uuid.UUID  `json:"user_id"`
+	RequestID  *uuid.UUID `json:"request_id,omitempty"` // Shared by the rows of one push or pull
 	DeviceID   *uuid.UUID `json:"device_id,omitempty"`
+	DeviceName string     `json:"device_name,omitempty"`
 	Action     string     `json:"action"`
 	DataType   string     `json:"data_type,omitempty"`
-	ItemsCount int        `json:"items_count"`
+	ItemsCount int        `json:"items_count"` // Upserts + deletes
+	Upserts    int        `json:"upserts"`
+	Deletes    int        `json:"deletes"`
+	Bytes      int64      `json:"bytes"`                 // Blob + nonce of the transferred items
+	DurationMs *int       `json:"duration_ms,omitempty"` // Server processing time
 	CreatedAt  time.Time  `json:"created_at"`
 }
 
@@ -80,6 +154,31 @@ type RegisterRequest struct {
 	Password string `json:"password" binding:"required,min=8"`
 }
 
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8"`
+}
+
+// ChangePasswordRequest for changing the password while logged in. Code is
+// required if TOTP is enabled.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+	Code            string `json:"code"`
+}
+
 type LoginRequest struct {
 	Email      string `json:"email" binding:"required,email"`
 	Password   string `json:"password" binding:"required"`
@@ -100,8 +199,9 @@ type RefreshRequest struct {
 }
 
 type RefreshResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int64  `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"` // Replaces the token sent; the old one is no longer valid
+	ExpiresIn    int64  `json:"expires_in"`
 }
 
 type SyncPushRequest struct {
@@ -109,42 +209,327 @@ type SyncPushRequest struct {
 	Items    []SyncPushItem `json:"items" binding:"required"`
 }
 
+// Blob and nonce are Base64 strings in JSON and raw bytes in CBOR
 type SyncPushItem struct {
 	DataType      string `json:"data_type" binding:"required"`
 	LocalID       string `json:"local_id" binding:"required"`
-	EncryptedBlob string `json:"encrypted_blob" binding:"required"` // Base64
-	Nonce         string `json:"nonce" binding:"required"`          // Base64
+	EncryptedBlob []byte `json:"encrypted_blob"` // Required unless deleted
+	Nonce         []byte `json:"nonce"`          // Required unless deleted
 	SchemaVersion int    `json:"schema_version"`
 	Deleted       bool   `json:"deleted"`
+	// Seq of the server version this edit is based on (0 = new item).
+	// Omit for last-writer-wins.
+	BaseRevision *int64 `json:"base_revision,omitempty"`
+	// Hashes of uploaded attachments the item references. Omit to keep the
+	// current references, send an empty list to drop them.
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// StorageLimits are the server-wide defaults for encrypted_data (0 = unlimited)
+type StorageLimits struct {
+	MaxItemBytes int
+	UserBytes    int64
+	UserItems    int
+}
+
+// StorageUsage is the current storage of a user and the quota that applies
+type StorageUsage struct {
+	UsedBytes       int64 `json:"used_bytes"` // Items and attachments
+	UsedItems       int   `json:"used_items"`
+	AttachmentBytes int64 `json:"attachment_bytes"`
+	QuotaBytes      int64 `json:"quota_bytes"` // 0 = unlimited
+	QuotaItems      int   `json:"quota_items"` // 0 = unlimited
+	MaxItemBytes    int   `json:"max_item_bytes"`
+}
+
+// Per-item push result statuses
+const (
+	SyncItemStatusOK       = "ok"       // Item was written
+	SyncItemStatusFailed   = "failed"   // Item caused the push to be rolled back
+	SyncItemStatusSkipped  = "skipped"  // Item was valid but not written because the push was rolled back
+	SyncItemStatusConflict = "conflict" // Base revision is stale; see Server for the current version
+)
+
+// SyncPushResult reports the outcome of a single pushed item
+type SyncPushResult struct {
+	Index    int           `json:"index"`
+	DataType string        `json:"data_type"`
+	LocalID  string        `json:"local_id"`
+	Status   string        `json:"status"`
+	Seq      int64         `json:"seq,omitempty"` // New revision of a written item
+	Error    string        `json:"error,omitempty"`
+	Server   *SyncPullItem `json:"server,omitempty"` // Current server version on conflict
+}
+
+type SyncPushResponse struct {
+	Message    string           `json:"message"`
+	ItemsCount int              `json:"items_count"`
+	Conflicts  int              `json:"conflicts"`
+	Timestamp  int64            `json:"timestamp"`
+	Results    []SyncPushResult `json:"results"`
 }
 
 type SyncPullRequest struct {
 	DeviceID string `form:"device_id" binding:"required"`
-	Since    int64  `form:"since"` // Unix timestamp
+	Cursor   string `form:"cursor"` // Opaque, from a previous next_cursor; empty = from the beginning
+	Limit    int    `form:"limit"`
 	DataType string `form:"data_type,omitempty"`
+	// Deprecated: Unix timestamp sent by apps from before cursors. Without a
+	// cursor all changes since then are returned in one unpaginated response.
+	Since int64 `form:"since"`
 }
 
 type SyncPullResponse struct {
-	Items     []SyncPullItem `json:"items"`
-	Timestamp int64          `json:"timestamp"`
+	Items      []SyncPullItem `json:"items"`
+	NextCursor string         `json:"next_cursor"`
+	HasMore    bool           `json:"has_more"`
+	// Items flagged unsupported; the app should offer an update
+	UnsupportedCount int   `json:"unsupported_count,omitempty"`
+	Timestamp        int64 `json:"timestamp"`
 }
 
 type SyncPullItem struct {
+	ID            string `json:"id"`
+	DataType      string `json:"data_type"`
+	LocalID       string `json:"local_id"`
+	EncryptedBlob []byte `json:"encrypted_blob"` // Base64 in JSON
+	Nonce         []byte `json:"nonce"`          // Base64 in JSON
+	SchemaVersion int    `json:"schema_version"`
+	KeyGeneration int    `json:"key_generation"` // Key the item is encrypted with
+	Seq           int64  `json:"seq"`            // Per-user change sequence
+	UpdatedAt     int64  `json:"updated_at"`
+	Deleted       bool   `json:"deleted"`
+	// Written with a newer schema than the pulling device declared it can decode
+	Unsupported bool     `json:"unsupported,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// Snapshot stream: a SnapshotHeader, the live items as SyncPullItem, then a
+// SnapshotTrailer
+const (
+	SnapshotFormat  = "vibedtracker-snapshot"
+	SnapshotVersion = 1
+)
+
+type SyncSnapshotRequest struct {
+	DeviceID string `form:"device_id" binding:"required"`
+	DataType string `form:"data_type"`
+}
+
+// SnapshotHeader is the first record of a snapshot. Incremental pulls
+// continue from Cursor once the snapshot is applied.
+type SnapshotHeader struct {
+	Format      string `json:"format"`
+	Version     int    `json:"version"`
+	Cursor      string `json:"cursor"`
+	DataType    string `json:"data_type,omitempty"`
+	GeneratedAt int64  `json:"generated_at"`
+}
+
+// SnapshotTrailer is the last record; a snapshot without it is incomplete
+type SnapshotTrailer struct {
+	Complete         bool `json:"complete"`
+	ItemCount        int  `json:"item_count"`
+	UnsupportedCount int  `json:"unsupported_count,omitempty"`
+}
+
+// SyncRevision is an archived earlier version of an encrypted item
+type SyncRevision struct {
 	ID            string `json:"id"`
 	DataType      string `json:"data_type"`
 	LocalID       string `json:"local_id"`
 	EncryptedBlob string `json:"encrypted_blob"` // Base64
 	Nonce         string `json:"nonce"`          // Base64
 	SchemaVersion int    `json:"schema_version"`
-	UpdatedAt     int64  `json:"updated_at"`
+	KeyGeneration int    `json:"key_generation"`
+	Seq           int64  `json:"seq"`
 	Deleted       bool   `json:"deleted"`
+	ValidFrom     int64  `json:"valid_from"`    // Unix timestamp
+	SupersededAt  int64  `json:"superseded_at"` // Unix timestamp
+	// Attachments restored together with this version
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+type SyncRevisionsRequest struct {
+	DataType string `form:"data_type" binding:"required"`
+	LocalID  string `form:"local_id" binding:"required"`
+}
+
+// SyncLogRequest filters the sync activity log; all filters are optional
+type SyncLogRequest struct {
+	DeviceID string `form:"device_id"`
+	Action   string `form:"action"`
+	DataType string `form:"data_type"`
+	From     int64  `form:"from"` // Unix timestamp, inclusive
+	To       int64  `form:"to"`   // Unix timestamp, exclusive
+	Cursor   string `form:"cursor"`
+	Limit    int    `form:"limit"`
+	TimeZone string `form:"tz"` // IANA name for grouping by day, default UTC
+}
+
+// SyncLogFilter is the parsed form of SyncLogRequest
+type SyncLogFilter struct {
+	DeviceID *uuid.UUID
+	Action   string
+	DataType string
+	From     *time.Time
+	To       *time.Time
+	// Keyset position: return entries older than (BeforeTime, BeforeID)
+	BeforeTime *time.Time
+	BeforeID   uuid.UUID
+}
+
+type SyncLogResponse struct {
+	Entries    []SyncLog `json:"entries"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	HasMore    bool      `json:"has_more"`
+}
+
+// SyncLogDay sums the log entries of one action on one day
+type SyncLogDay struct {
+	Date       string `json:"date"` // YYYY-MM-DD in the requested time zone
+	Action     string `json:"action"`
+	Entries    int    `json:"entries"` // Requests
+	ItemsCount int    `json:"items_count"`
+	Upserts    int    `json:"upserts"`
+	Deletes    int    `json:"deletes"`
+	Bytes      int64  `json:"bytes"`
+}
+
+type RestoreRevisionRequest struct {
+	DeviceID string `json:"device_id" binding:"required"`
+}
+
+type RestoreAccountRequest struct {
+	DeviceID  string `json:"device_id" binding:"required"`
+	Timestamp int64  `json:"timestamp" binding:"required"` // Unix timestamp to restore to
+}
+
+type PurgeDeletedRequest struct {
+	DeviceID string `json:"device_id" binding:"required"`
+}
+
+type RestoreAccountResponse struct {
+	Restored    int   `json:"restored"`    // Items set back to their earlier version
+	Deleted     int   `json:"deleted"`     // Items that did not exist at that time
+	Unavailable int   `json:"unavailable"` // Items whose history has already expired
+	Timestamp   int64 `json:"timestamp"`
+}
+
+// Vault archive format (export/import of all encrypted data)
+const (
+	VaultArchiveFormat  = "vibedtracker-vault"
+	VaultArchiveVersion = 1
+)
+
+// Import modes for items that exist in both the archive and the account
+const (
+	ImportModeMerge     = "merge"     // Keep existing items, only add new ones
+	ImportModeOverwrite = "overwrite" // Archive wins for items in both
+	ImportModeReplace   = "replace"   // Account becomes exactly the archive
+)
+
+// VaultHeader describes a vault archive. Byte fields are Base64 in JSON.
+type VaultHeader struct {
+	Format              string    `json:"format"`
+	Version             int       `json:"version"`
+	ExportedAt          time.Time `json:"exported_at"`
+	KeySalt             []byte    `json:"key_salt"`
+	KeyVerificationHash []byte    `json:"key_verification_hash"`
+}
+
+type VaultArchive struct {
+	VaultHeader
+	Items []VaultItem `json:"items"`
+}
+
+type VaultItem struct {
+	DataType      string    `json:"data_type"`
+	LocalID       string    `json:"local_id"`
+	EncryptedBlob []byte    `json:"encrypted_blob"`
+	Nonce         []byte    `json:"nonce"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type ImportRequest struct {
+	DeviceID string `form:"device_id" binding:"required"`
+	Mode     string `form:"mode" binding:"omitempty,oneof=merge overwrite replace"`
+}
+
+type ImportResponse struct {
+	Mode        string `json:"mode"`
+	Imported    int    `json:"imported"`
+	Skipped     int    `json:"skipped"` // Existing items kept in merge mode
+	Deleted     int    `json:"deleted"` // Items removed in replace mode
+	KeyImported bool   `json:"key_imported"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// Attachment is a client-encrypted file stored outside encrypted_data,
+// addressed by the SHA-256 of its encrypted content
+type Attachment struct {
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	RefCount  int       `json:"ref_count"` // Items and revisions referencing it
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AttachmentUpload is a chunked upload; chunks are appended at Offset
+type AttachmentUpload struct {
+	ID        uuid.UUID `json:"id"`
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"` // Bytes received so far
+	Complete  bool      `json:"complete"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CreateAttachmentUploadRequest struct {
+	Hash string `json:"hash" binding:"required"` // SHA-256 (hex) of the encrypted file
+	Size int64  `json:"size" binding:"required,min=1"`
+}
+
+type UploadChunkRequest struct {
+	Offset *int64 `form:"offset" binding:"required,min=0"`
+}
+
+// SyncEvent announces committed changes to a user's sync data
+type SyncEvent struct {
+	UserID    uuid.UUID `json:"user_id"`
+	DeviceID  uuid.UUID `json:"device_id"` // Device that wrote the changes
+	Seq       int64     `json:"seq"`       // Highest change sequence written (0 = no sync data written)
+	DataTypes []string  `json:"data_types"`
+}
+
+// Timer (active session) request types
+
+type StartTimerRequest struct {
+	DeviceID         string `json:"device_id" binding:"required"`
+	WorkEntryLocalID string `json:"work_entry_local_id" binding:"required"`
+	StartedAt        int64  `json:"started_at"` // Unix timestamp, defaults to now
+	Force            bool   `json:"force"`      // Take over a timer running on another device
+}
+
+type StopTimerRequest struct {
+	DeviceID         string `json:"device_id" binding:"required"`
+	WorkEntryLocalID string `json:"work_entry_local_id"` // Optional: only stop if this entry is running
 }
 
 type RegisterDeviceRequest struct {
-	DeviceName  string `json:"device_name" binding:"required"`
-	DeviceType  string `json:"device_type" binding:"required"`
-	DeviceModel string `json:"device_model,omitempty"`
-	AppVersion  string `json:"app_version,omitempty"`
+	DeviceName     string         `json:"device_name" binding:"required"`
+	DeviceType     string         `json:"device_type" binding:"required"`
+	DeviceModel    string         `json:"device_model,omitempty"`
+	AppVersion     string         `json:"app_version,omitempty"`
+	SchemaVersions map[string]int `json:"schema_versions,omitempty"`
+}
+
+// UpdateDeviceCapabilitiesRequest is sent by a device after an app update
+type UpdateDeviceCapabilitiesRequest struct {
+	AppVersion     string         `json:"app_version"`
+	SchemaVersions map[string]int `json:"schema_versions"`
 }
 
 type AdminUserListResponse struct {
@@ -153,12 +538,42 @@ type AdminUserListResponse struct {
 }
 
 type AdminStatsResponse struct {
-	TotalUsers     int `json:"total_users"`
-	ApprovedUsers  int `json:"approved_users"`
-	PendingUsers   int `json:"pending_users"`
-	BlockedUsers   int `json:"blocked_users"`
-	TotalDevices   int `json:"total_devices"`
-	TotalSyncItems int `json:"total_sync_items"`
+	TotalUsers        int                `json:"total_users"`
+	ApprovedUsers     int                `json:"approved_users"`
+	PendingUsers      int                `json:"pending_users"`
+	BlockedUsers      int                `json:"blocked_users"`
+	TotalDevices      int                `json:"total_devices"`
+	TotalSyncItems    int                `json:"total_sync_items"`
+	TotalStorageBytes int64              `json:"total_storage_bytes"`
+	StorageByUser     []UserStorageStats `json:"storage_by_user"`
+	// Sync activity of all users over the last 7 days
+	SyncByDataType []DataTypeSyncStats `json:"sync_by_data_type"`
+}
+
+// DataTypeSyncStats sums the sync log of one data type. Written counts
+// pushes, imports and restores.
+type DataTypeSyncStats struct {
+	DataType     string `json:"data_type"`
+	Upserts      int    `json:"upserts"`
+	Deletes      int    `json:"deletes"`
+	WrittenBytes int64  `json:"written_bytes"`
+	PulledItems  int    `json:"pulled_items"`
+	PulledBytes  int64  `json:"pulled_bytes"`
+}
+
+type UserStorageStats struct {
+	UserID     uuid.UUID `json:"user_id"`
+	Email      string    `json:"email"`
+	UsedBytes  int64     `json:"used_bytes"`
+	UsedItems  int       `json:"used_items"`
+	QuotaBytes *int64    `json:"quota_bytes,omitempty"` // Override, nil = default
+	QuotaItems *int      `json:"quota_items,omitempty"`
+}
+
+// SetQuotaRequest overrides a user's quota; null restores the server default
+type SetQuotaRequest struct {
+	QuotaBytes *int64 `json:"quota_bytes" binding:"omitempty,min=0"`
+	QuotaItems *int   `json:"quota_items" binding:"omitempty,min=0"`
 }
 
 type SetKeyRequest struct {
@@ -237,6 +652,29 @@ type SetKeyResponse struct {
 	RecoveryCodes []string `json:"recovery_codes,omitempty"` // Only returned on first setup
 }
 
+// Key rotation models
+
+// KeyRotationStatus is the key generation of a user and the progress of a running rotation
+type KeyRotationStatus struct {
+	KeyGeneration    int        `json:"key_generation"`
+	InProgress       bool       `json:"in_progress"`
+	DeviceID         *uuid.UUID `json:"device_id,omitempty"` // Device re-encrypting; all others pause pushing
+	TargetGeneration *int       `json:"target_generation,omitempty"`
+	StartedAt        *int64     `json:"started_at,omitempty"`
+	TotalItems       int        `json:"total_items,omitempty"`
+	RemainingItems   int        `json:"remaining_items,omitempty"` // Items still under the old key
+}
+
+type StartKeyRotationRequest struct {
+	DeviceID               string `json:"device_id" binding:"required"`
+	NewKeySalt             string `json:"new_key_salt" binding:"required"`              // Base64
+	NewKeyVerificationHash string `json:"new_key_verification_hash" binding:"required"` // Base64
+}
+
+type KeyRotationRequest struct {
+	DeviceID string `json:"device_id" binding:"required"`
+}
+
 // PassphraseRecoveryValidateRequest for validating a passphrase recovery code
 type PassphraseRecoveryValidateRequest struct {
 	Code string `json:"code" binding:"required"`
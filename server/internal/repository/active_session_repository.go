@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+var (
+	ErrActiveSessionNotFound = errors.New("no active session")
+	ErrActiveSessionConflict = errors.New("another timer is already running")
+)
+
+// activeSessionDataType is reported in sync events when the running timer changes
+const activeSessionDataType = "active_session"
+
+// ActiveSessionRepository stores the one running timer per user. Only the
+// work entry's local ID and start time are kept; the entry itself stays encrypted.
+type ActiveSessionRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewActiveSessionRepository(pool *pgxpool.Pool) *ActiveSessionRepository {
+	return &ActiveSessionRepository{pool: pool}
+}
+
+func (r *ActiveSessionRepository) Get(ctx context.Context, userID uuid.UUID) (*models.ActiveSession, error) {
+	return getActiveSession(ctx, r.pool, userID)
+}
+
+func getActiveSession(ctx context.Context, q rowQuerier, userID uuid.UUID) (*models.ActiveSession, error) {
+	session := &models.ActiveSession{}
+	err := q.QueryRow(ctx, `
+		SELECT id, user_id, device_id, work_entry_local_id, started_at, created_at, updated_at
+		FROM active_sessions WHERE user_id = $1
+	`, userID).Scan(
+		&session.ID, &session.UserID, &session.DeviceID, &session.WorkEntryLocalID,
+		&session.StartedAt, &session.CreatedAt, &session.UpdatedAt,
+	)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrActiveSessionNotFound
+	}
+	return session, err
+}
+
+// Start records a running timer. If a different timer is already running it
+// is returned together with ErrActiveSessionConflict, unless force is set.
+// Starting the same work entry again is a no-op.
+func (r *ActiveSessionRepository) Start(ctx context.Context, userID, deviceID uuid.UUID, localID string, startedAt time.Time, force bool) (*models.ActiveSession, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	session := &models.ActiveSession{
+		ID:               uuid.New(),
+		UserID:           userID,
+		DeviceID:         &deviceID,
+		WorkEntryLocalID: localID,
+		StartedAt:        startedAt,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+
+	// Decide in the upsert itself; locking a missing row would not keep a
+	// concurrent start from overwriting this one
+	for {
+		err = tx.QueryRow(ctx, `
+			INSERT INTO active_sessions (id, user_id, device_id, work_entry_local_id, started_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (user_id)
+			DO UPDATE SET device_id = $3, work_entry_local_id = $4, started_at = $5, created_at = $6, updated_at = $7
+			WHERE $8 AND active_sessions.work_entry_local_id <> EXCLUDED.work_entry_local_id
+			RETURNING id
+		`, session.ID, session.UserID, session.DeviceID, session.WorkEntryLocalID, session.StartedAt, session.CreatedAt, session.UpdatedAt, force).Scan(&session.ID)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+
+		// Not written: the running timer is kept
+		existing, err := getActiveSession(ctx, tx, userID)
+		if errors.Is(err, ErrActiveSessionNotFound) {
+			// Stopped in the meantime, try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if existing.WorkEntryLocalID == localID {
+			return existing, nil
+		}
+		return existing, ErrActiveSessionConflict
+	}
+
+	if err := notifyChange(ctx, tx, userID, deviceID, activeSessionDataType); err != nil {
+		return nil, err
+	}
+
+	return session, tx.Commit(ctx)
+}
+
+// Stop ends the running timer. With a non-empty localID only that work
+// entry's timer is stopped.
+func (r *ActiveSessionRepository) Stop(ctx context.Context, userID, deviceID uuid.UUID, localID string) (*models.ActiveSession, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	session := &models.ActiveSession{}
+	err = tx.QueryRow(ctx, `
+		DELETE FROM active_sessions
+		WHERE user_id = $1 AND ($2 = '' OR work_entry_local_id = $2)
+		RETURNING id, user_id, device_id, work_entry_local_id, started_at, created_at, updated_at
+	`, userID, localID).Scan(
+		&session.ID, &session.UserID, &session.DeviceID, &session.WorkEntryLocalID,
+		&session.StartedAt, &session.CreatedAt, &session.UpdatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrActiveSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := notifyChange(ctx, tx, userID, deviceID, activeSessionDataType); err != nil {
+		return nil, err
+	}
+
+	return session, tx.Commit(ctx)
+}
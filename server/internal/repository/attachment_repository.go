@@ -0,0 +1,404 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+	"github.com/sprobst76/vibedtracker-server/internal/storage"
+)
+
+var (
+	ErrAttachmentNotFound     = errors.New("attachment not found")
+	ErrInvalidAttachmentHash  = errors.New("attachment hash must be a lowercase hex SHA-256")
+	ErrUploadNotFound         = errors.New("upload not found")
+	ErrUploadOffsetMismatch   = errors.New("chunk offset does not match the upload offset")
+	ErrUploadTooLarge         = errors.New("chunk exceeds the announced upload size")
+	ErrAttachmentHashMismatch = errors.New("uploaded content does not match the announced hash")
+)
+
+// maxItemAttachments limits the attachment references of a single item
+const maxItemAttachments = 32
+
+type AttachmentRepository struct {
+	pool  *pgxpool.Pool
+	store storage.BlobStore
+	sync  *SyncRepository // Storage usage and quota
+}
+
+func NewAttachmentRepository(pool *pgxpool.Pool, store storage.BlobStore, sync *SyncRepository) *AttachmentRepository {
+	return &AttachmentRepository{pool: pool, store: store, sync: sync}
+}
+
+// Blob keys: finished attachments are content-addressed per user, uploads by id
+func attachmentKey(userID uuid.UUID, hash string) string {
+	return fmt.Sprintf("%s/%s/%s", userID, hash[:2], hash)
+}
+
+func uploadKey(uploadID uuid.UUID) string {
+	return "uploads/" + uploadID.String()
+}
+
+func isAttachmentHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns an attachment of the user with its current reference count
+func (r *AttachmentRepository) Get(ctx context.Context, userID uuid.UUID, hash string) (*models.Attachment, error) {
+	if !isAttachmentHash(hash) {
+		return nil, ErrAttachmentNotFound
+	}
+
+	a := &models.Attachment{Hash: hash}
+	err := r.pool.QueryRow(ctx, `
+		SELECT a.size, a.created_at,
+		       (SELECT COUNT(*) FROM encrypted_data e WHERE e.user_id = a.user_id AND e.attachments @> ARRAY[a.hash]::text[]) +
+		       (SELECT COUNT(*) FROM encrypted_data_revisions v WHERE v.user_id = a.user_id AND v.attachments @> ARRAY[a.hash]::text[])
+		FROM attachments a
+		WHERE a.user_id = $1 AND a.hash = $2
+	`, userID, hash).Scan(&a.Size, &a.CreatedAt, &a.RefCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Open returns the content of an attachment for (ranged) reading
+func (r *AttachmentRepository) Open(ctx context.Context, userID uuid.UUID, hash string) (io.ReadSeekCloser, *models.Attachment, error) {
+	a, err := r.Get(ctx, userID, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, _, err := r.store.Open(ctx, attachmentKey(userID, hash))
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, a, nil
+}
+
+// CreateUpload starts a chunked upload of a file with the given hash and
+// size. Unfinished uploads count towards the storage quota, so parallel
+// uploads cannot overshoot it; ErrQuotaExceeded is returned if the file does
+// not fit anymore.
+func (r *AttachmentRepository) CreateUpload(ctx context.Context, userID uuid.UUID, hash string, size int64) (*models.AttachmentUpload, error) {
+	if !isAttachmentHash(hash) {
+		return nil, ErrInvalidAttachmentHash
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Same lock as pushes, so the usage cannot change underneath us
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return nil, err
+	}
+	usage, err := r.sync.storageUsage(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var pending int64
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(SUM(size), 0)::bigint FROM attachment_uploads WHERE user_id = $1
+	`, userID).Scan(&pending)
+	if err != nil {
+		return nil, err
+	}
+	if usage.QuotaBytes > 0 && usage.UsedBytes+pending+size > usage.QuotaBytes {
+		return nil, ErrQuotaExceeded
+	}
+
+	upload := &models.AttachmentUpload{ID: uuid.New(), Hash: hash, Size: size}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO attachment_uploads (id, user_id, hash, size)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at, updated_at
+	`, upload.ID, userID, hash, size).Scan(&upload.CreatedAt, &upload.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return upload, tx.Commit(ctx)
+}
+
+// GetUpload returns an unfinished upload, e.g. to resume it after a disconnect
+func (r *AttachmentRepository) GetUpload(ctx context.Context, userID, uploadID uuid.UUID) (*models.AttachmentUpload, error) {
+	return getUpload(ctx, r.pool, userID, uploadID, "")
+}
+
+func getUpload(ctx context.Context, q rowQuerier, userID, uploadID uuid.UUID, lock string) (*models.AttachmentUpload, error) {
+	upload := &models.AttachmentUpload{ID: uploadID}
+	err := q.QueryRow(ctx, `
+		SELECT hash, size, received, created_at, updated_at
+		FROM attachment_uploads
+		WHERE id = $1 AND user_id = $2
+	`+lock, uploadID, userID).Scan(&upload.Hash, &upload.Size, &upload.Offset, &upload.CreatedAt, &upload.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// WriteChunk appends a chunk at offset. The chunk is received into a
+// temporary file first; only storing it locks the upload row, so concurrent
+// chunks for the same upload are serialized without a slow client holding a
+// connection. Once all bytes arrived the content is verified against the
+// announced hash and stored as attachment; the returned upload is then
+// marked complete. On ErrUploadOffsetMismatch the current upload is
+// returned as well.
+func (r *AttachmentRepository) WriteChunk(ctx context.Context, userID, uploadID uuid.UUID, offset int64, chunk io.Reader) (*models.AttachmentUpload, error) {
+	upload, err := getUpload(ctx, r.pool, userID, uploadID, "")
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrUploadOffsetMismatch
+	}
+
+	tmp, err := os.CreateTemp("", "vibedtracker-chunk-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Read one byte more than missing to notice oversized chunks
+	remaining := upload.Size - upload.Offset
+	n, err := io.Copy(tmp, io.LimitReader(chunk, remaining+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > remaining {
+		return nil, ErrUploadTooLarge
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Another chunk may have been stored in the meantime
+	upload, err = getUpload(ctx, tx, userID, uploadID, " FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrUploadOffsetMismatch
+	}
+	if _, err := r.store.Append(ctx, uploadKey(uploadID), offset, tmp); err != nil {
+		return nil, err
+	}
+
+	upload.Offset += n
+	upload.UpdatedAt = time.Now()
+	if upload.Offset < upload.Size {
+		_, err = tx.Exec(ctx, `
+			UPDATE attachment_uploads SET received = $2, updated_at = $3 WHERE id = $1
+		`, uploadID, upload.Offset, upload.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		return upload, tx.Commit(ctx)
+	}
+
+	if err := r.finishUpload(ctx, tx, userID, upload); err != nil {
+		return nil, err
+	}
+	upload.Complete = true
+	return upload, nil
+}
+
+// finishUpload verifies a fully received upload and turns it into an attachment
+func (r *AttachmentRepository) finishUpload(ctx context.Context, tx pgx.Tx, userID uuid.UUID, upload *models.AttachmentUpload) error {
+	key := uploadKey(upload.ID)
+	f, _, err := r.store.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != upload.Hash {
+		// The content is unusable, the client has to start over
+		if _, err := tx.Exec(ctx, `DELETE FROM attachment_uploads WHERE id = $1`, upload.ID); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		if err := r.store.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete rejected upload %s: %v", upload.ID, err)
+		}
+		return ErrAttachmentHashMismatch
+	}
+
+	// Same content may have been uploaded twice; the blob is identical then
+	if err := r.store.Move(ctx, key, attachmentKey(userID, upload.Hash)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO attachments (user_id, hash, size, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, hash) DO NOTHING
+	`, userID, upload.Hash, upload.Size, upload.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM attachment_uploads WHERE id = $1`, upload.ID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// CancelUpload drops an unfinished upload and its received chunks
+func (r *AttachmentRepository) CancelUpload(ctx context.Context, userID, uploadID uuid.UUID) error {
+	tag, err := r.pool.Exec(ctx, `DELETE FROM attachment_uploads WHERE id = $1 AND user_id = $2`, uploadID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUploadNotFound
+	}
+	return r.store.Delete(ctx, uploadKey(uploadID))
+}
+
+// Cleanup removes uploads abandoned before the cutoff and attachments created
+// before the cutoff that no item or revision references (anymore). The grace
+// period gives clients time to push the item referencing a fresh upload.
+func (r *AttachmentRepository) Cleanup(ctx context.Context, cutoff time.Time) error {
+	rows, err := r.pool.Query(ctx, `
+		DELETE FROM attachment_uploads WHERE updated_at < $1 RETURNING id
+	`, cutoff)
+	if err != nil {
+		return err
+	}
+	uploadIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return err
+	}
+	for _, id := range uploadIDs {
+		if err := r.store.Delete(ctx, uploadKey(id)); err != nil {
+			return err
+		}
+	}
+
+	rows, err = r.pool.Query(ctx, `
+		DELETE FROM attachments a
+		WHERE a.created_at < $1
+		  AND NOT EXISTS (SELECT 1 FROM encrypted_data e WHERE e.user_id = a.user_id AND e.attachments @> ARRAY[a.hash]::text[])
+		  AND NOT EXISTS (SELECT 1 FROM encrypted_data_revisions v WHERE v.user_id = a.user_id AND v.attachments @> ARRAY[a.hash]::text[])
+		RETURNING a.user_id, a.hash
+	`, cutoff)
+	if err != nil {
+		return err
+	}
+	type unreferenced struct {
+		UserID uuid.UUID
+		Hash   string
+	}
+	orphans, err := pgx.CollectRows(rows, pgx.RowToStructByPos[unreferenced])
+	if err != nil {
+		return err
+	}
+	for _, o := range orphans {
+		if err := r.store.Delete(ctx, attachmentKey(o.UserID, o.Hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAttachmentRefs checks the attachment list of a pushed item
+func validateAttachmentRefs(hashes []string) error {
+	if len(hashes) > maxItemAttachments {
+		return fmt.Errorf("too many attachments (max %d)", maxItemAttachments)
+	}
+	for _, hash := range hashes {
+		if !isAttachmentHash(hash) {
+			return ErrInvalidAttachmentHash
+		}
+	}
+	return nil
+}
+
+// checkAttachmentRefs fails every write that references an attachment the
+// user has not uploaded and returns ErrPushRejected in that case
+func checkAttachmentRefs(ctx context.Context, tx pgx.Tx, userID uuid.UUID, writes []itemWrite, results []models.SyncPushResult) error {
+	var hashes []string
+	for _, w := range writes {
+		hashes = append(hashes, w.Attachments...)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	// Lock the rows so the cleanup cannot remove them before the push commits
+	rows, err := tx.Query(ctx, `
+		SELECT hash FROM attachments WHERE user_id = $1 AND hash = ANY($2::text[]) FOR SHARE
+	`, userID, hashes)
+	if err != nil {
+		return err
+	}
+	found, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(found))
+	for _, hash := range found {
+		known[hash] = true
+	}
+
+	rejected := false
+	for i, w := range writes {
+		for _, hash := range w.Attachments {
+			if !known[hash] {
+				results[i].Status = models.SyncItemStatusFailed
+				results[i].Error = "unknown attachment " + hash
+				rejected = true
+				break
+			}
+		}
+	}
+	if rejected {
+		return ErrPushRejected
+	}
+	return nil
+}
@@ -23,20 +23,24 @@ func NewDeviceRepository(pool *pgxpool.Pool) *DeviceRepository {
 
 func (r *DeviceRepository) Create(ctx context.Context, userID uuid.UUID, req *models.RegisterDeviceRequest) (*models.Device, error) {
 	device := &models.Device{
-		ID:          uuid.New(),
-		UserID:      userID,
-		DeviceName:  req.DeviceName,
-		DeviceType:  req.DeviceType,
-		DeviceModel: req.DeviceModel,
-		AppVersion:  req.AppVersion,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		ID:             uuid.New(),
+		UserID:         userID,
+		DeviceName:     req.DeviceName,
+		DeviceType:     req.DeviceType,
+		DeviceModel:    req.DeviceModel,
+		AppVersion:     req.AppVersion,
+		SchemaVersions: req.SchemaVersions,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	if device.SchemaVersions == nil {
+		device.SchemaVersions = map[string]int{}
 	}
 
 	_, err := r.pool.Exec(ctx, `
-		INSERT INTO devices (id, user_id, device_name, device_type, device_model, app_version, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	`, device.ID, device.UserID, device.DeviceName, device.DeviceType, device.DeviceModel, device.AppVersion, device.CreatedAt, device.UpdatedAt)
+		INSERT INTO devices (id, user_id, device_name, device_type, device_model, app_version, schema_versions, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, device.ID, device.UserID, device.DeviceName, device.DeviceType, device.DeviceModel, device.AppVersion, device.SchemaVersions, device.CreatedAt, device.UpdatedAt)
 
 	return device, err
 }
@@ -44,11 +48,11 @@ func (r *DeviceRepository) Create(ctx context.Context, userID uuid.UUID, req *mo
 func (r *DeviceRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Device, error) {
 	device := &models.Device{}
 	err := r.pool.QueryRow(ctx, `
-		SELECT id, user_id, device_name, device_type, device_model, app_version, last_sync, created_at, updated_at
+		SELECT id, user_id, device_name, device_type, COALESCE(device_model, ''), COALESCE(app_version, ''), schema_versions, last_sync, token_reuse_at, created_at, updated_at
 		FROM devices WHERE id = $1
 	`, id).Scan(
 		&device.ID, &device.UserID, &device.DeviceName, &device.DeviceType, &device.DeviceModel,
-		&device.AppVersion, &device.LastSync, &device.CreatedAt, &device.UpdatedAt,
+		&device.AppVersion, &device.SchemaVersions, &device.LastSync, &device.TokenReuseAt, &device.CreatedAt, &device.UpdatedAt,
 	)
 
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -59,7 +63,7 @@ func (r *DeviceRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.D
 
 func (r *DeviceRepository) GetByUserID(ctx context.Context, userID uuid.UUID) ([]models.Device, error) {
 	rows, err := r.pool.Query(ctx, `
-		SELECT id, user_id, device_name, device_type, device_model, app_version, last_sync, created_at, updated_at
+		SELECT id, user_id, device_name, device_type, COALESCE(device_model, ''), COALESCE(app_version, ''), schema_versions, last_sync, token_reuse_at, created_at, updated_at
 		FROM devices WHERE user_id = $1 ORDER BY created_at DESC
 	`, userID)
 	if err != nil {
@@ -72,7 +76,7 @@ func (r *DeviceRepository) GetByUserID(ctx context.Context, userID uuid.UUID) ([
 		var device models.Device
 		err := rows.Scan(
 			&device.ID, &device.UserID, &device.DeviceName, &device.DeviceType, &device.DeviceModel,
-			&device.AppVersion, &device.LastSync, &device.CreatedAt, &device.UpdatedAt,
+			&device.AppVersion, &device.SchemaVersions, &device.LastSync, &device.TokenReuseAt, &device.CreatedAt, &device.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -88,12 +92,102 @@ func (r *DeviceRepository) Delete(ctx context.Context, id uuid.UUID) error {
 	return err
 }
 
+// UpdateCapabilities stores the app version and decodable schema versions a
+// device reports, e.g. after an app update
+func (r *DeviceRepository) UpdateCapabilities(ctx context.Context, id uuid.UUID, appVersion string, schemaVersions map[string]int) error {
+	if schemaVersions == nil {
+		schemaVersions = map[string]int{}
+	}
+	tag, err := r.pool.Exec(ctx, `
+		UPDATE devices SET app_version = $1, schema_versions = $2, updated_at = $3 WHERE id = $4
+	`, appVersion, schemaVersions, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
 func (r *DeviceRepository) UpdateLastSync(ctx context.Context, id uuid.UUID) error {
 	now := time.Now()
 	_, err := r.pool.Exec(ctx, `UPDATE devices SET last_sync = $1, updated_at = $1 WHERE id = $2`, now, id)
 	return err
 }
 
+// FlagTokenReuse marks a device whose rotated refresh token was presented
+// again, i.e. whose token has probably been stolen
+func (r *DeviceRepository) FlagTokenReuse(ctx context.Context, id uuid.UUID) error {
+	now := time.Now()
+	_, err := r.pool.Exec(ctx, `UPDATE devices SET token_reuse_at = $1, updated_at = $1 WHERE id = $2`, now, id)
+	return err
+}
+
+// AckCursor stores the cursor a device pulled with; everything before it has
+// been received. An empty data type means a pull over all data types.
+func (r *DeviceRepository) AckCursor(ctx context.Context, id uuid.UUID, dataType string, seq int64) error {
+	if dataType == "" {
+		dataType = models.AllDataTypes
+	}
+	_, err := r.pool.Exec(ctx, `
+		INSERT INTO device_cursors (device_id, data_type, seq, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (device_id, data_type) DO UPDATE SET seq = EXCLUDED.seq, updated_at = EXCLUDED.updated_at
+	`, id, dataType, seq, time.Now())
+	return err
+}
+
+// SyncHealth returns the acknowledged cursors and the number of pending
+// changes per device. Changes count as pending if another device wrote them
+// after the highest cursor the device acknowledged for their data type.
+// Devices without sync for staleAfter (0 = never) are marked stale.
+func (r *DeviceRepository) SyncHealth(ctx context.Context, ids []uuid.UUID, staleAfter time.Duration) (map[uuid.UUID]*models.DeviceSyncHealth, error) {
+	rows, err := r.pool.Query(ctx, `
+		WITH cursors AS (
+			SELECT device_id, jsonb_object_agg(data_type, seq) AS cursors
+			FROM device_cursors
+			WHERE device_id = ANY($1)
+			GROUP BY device_id
+		), pending AS (
+			-- One pass over the users' items; the all-types cursor bounds the seq range
+			SELECT d.id, COUNT(*) AS changes
+			FROM devices d
+			LEFT JOIN device_cursors ca ON ca.device_id = d.id AND ca.data_type = $2
+			JOIN encrypted_data e ON e.user_id = d.user_id AND e.seq > COALESCE(ca.seq, 0)
+			LEFT JOIN device_cursors ct ON ct.device_id = d.id AND ct.data_type = e.data_type
+			WHERE d.id = ANY($1) AND e.device_id IS DISTINCT FROM d.id AND e.seq > COALESCE(ct.seq, 0)
+			GROUP BY d.id
+		)
+		SELECT d.id, COALESCE(d.last_sync, d.created_at), COALESCE(c.cursors, '{}'), COALESCE(p.changes, 0)
+		FROM devices d
+		LEFT JOIN cursors c ON c.device_id = d.id
+		LEFT JOIN pending p ON p.id = d.id
+		WHERE d.id = ANY($1)
+	`, ids, models.AllDataTypes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	health := make(map[uuid.UUID]*models.DeviceSyncHealth, len(ids))
+	for rows.Next() {
+		var id uuid.UUID
+		var lastSeen time.Time
+		h := &models.DeviceSyncHealth{}
+		if err := rows.Scan(&id, &lastSeen, &h.Cursors, &h.PendingChanges); err != nil {
+			return nil, err
+		}
+		since := now.Sub(lastSeen)
+		h.DaysSinceSync = int(since / (24 * time.Hour))
+		h.Stale = staleAfter > 0 && since > staleAfter
+		health[id] = h
+	}
+
+	return health, rows.Err()
+}
+
 // DeviceWithUser includes user email for admin listing
 type DeviceWithUser struct {
 	models.Device
@@ -102,7 +196,7 @@ type DeviceWithUser struct {
 
 func (r *DeviceRepository) ListAll(ctx context.Context) ([]DeviceWithUser, error) {
 	rows, err := r.pool.Query(ctx, `
-		SELECT d.id, d.user_id, d.device_name, d.device_type, d.device_model, d.app_version, d.last_sync, d.created_at, d.updated_at, u.email
+		SELECT d.id, d.user_id, d.device_name, d.device_type, COALESCE(d.device_model, ''), COALESCE(d.app_version, ''), d.schema_versions, d.last_sync, d.token_reuse_at, d.created_at, d.updated_at, u.email
 		FROM devices d
 		JOIN users u ON d.user_id = u.id
 		ORDER BY d.created_at DESC
@@ -117,7 +211,7 @@ func (r *DeviceRepository) ListAll(ctx context.Context) ([]DeviceWithUser, error
 		var device DeviceWithUser
 		err := rows.Scan(
 			&device.ID, &device.UserID, &device.DeviceName, &device.DeviceType, &device.DeviceModel,
-			&device.AppVersion, &device.LastSync, &device.CreatedAt, &device.UpdatedAt, &device.UserEmail,
+			&device.AppVersion, &device.SchemaVersions, &device.LastSync, &device.TokenReuseAt, &device.CreatedAt, &device.UpdatedAt, &device.UserEmail,
 		)
 		if err != nil {
 			return nil, err
@@ -127,3 +221,55 @@ func (r *DeviceRepository) ListAll(ctx context.Context) ([]DeviceWithUser, error
 
 	return devices, rows.Err()
 }
+
+// GetOrCreateWebDevice returns the device the web interface syncs as for a
+// user, creating it on the first login. The user row is locked so that
+// concurrent logins don't create two of them.
+func (r *DeviceRepository) GetOrCreateWebDevice(ctx context.Context, userID uuid.UUID) (*models.Device, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR NO KEY UPDATE`, userID); err != nil {
+		return nil, err
+	}
+
+	device := &models.Device{}
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, device_name, device_type, COALESCE(device_model, ''), COALESCE(app_version, ''), schema_versions, last_sync, token_reuse_at, created_at, updated_at
+		FROM devices WHERE user_id = $1 AND device_type = $2 AND device_name = $3
+		ORDER BY created_at, id
+		LIMIT 1
+	`, userID, models.WebDeviceType, models.WebDeviceName).Scan(
+		&device.ID, &device.UserID, &device.DeviceName, &device.DeviceType, &device.DeviceModel,
+		&device.AppVersion, &device.SchemaVersions, &device.LastSync, &device.TokenReuseAt, &device.CreatedAt, &device.UpdatedAt,
+	)
+	if err == nil {
+		return device, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	now := time.Now()
+	device = &models.Device{
+		ID:             uuid.New(),
+		UserID:         userID,
+		DeviceName:     models.WebDeviceName,
+		DeviceType:     models.WebDeviceType,
+		SchemaVersions: map[string]int{},
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO devices (id, user_id, device_name, device_type, device_model, app_version, schema_versions, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, device.ID, device.UserID, device.DeviceName, device.DeviceType, device.DeviceModel, device.AppVersion, device.SchemaVersions, device.CreatedAt, device.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return device, tx.Commit(ctx)
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrVerificationTokenInvalid = errors.New("verification token invalid or expired")
+	ErrTooManyVerificationMails = errors.New("too many verification mails")
+)
+
+const (
+	EmailVerificationExpiry     = 48 * time.Hour
+	MaxVerificationMails        = 3 // Per user within VerificationMailWindow
+	VerificationMailWindow      = time.Hour
+	emailVerificationTokenBytes = 32
+)
+
+type EmailVerificationRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewEmailVerificationRepository(pool *pgxpool.Pool) *EmailVerificationRepository {
+	return &EmailVerificationRepository{pool: pool}
+}
+
+// lockUserMails serializes the mail rate limits of a user until tx ends
+func lockUserMails(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtextextended('mail:' || $1, 0))`, userID.String())
+	return err
+}
+
+// Create issues a verification token for a user and returns it. Only its
+// hash is stored. Returns ErrTooManyVerificationMails if the user already
+// got MaxVerificationMails within VerificationMailWindow.
+func (r *EmailVerificationRepository) Create(ctx context.Context, userID uuid.UUID) (string, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// Count and insert under one lock, so parallel requests cannot exceed the limit
+	if err := lockUserMails(ctx, tx, userID); err != nil {
+		return "", err
+	}
+
+	var recent int
+	err = tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM email_verifications WHERE user_id = $1 AND created_at > $2
+	`, userID, time.Now().Add(-VerificationMailWindow)).Scan(&recent)
+	if err != nil {
+		return "", err
+	}
+	if recent >= MaxVerificationMails {
+		return "", ErrTooManyVerificationMails
+	}
+
+	b := make([]byte, emailVerificationTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	now := time.Now()
+	_, err = tx.Exec(ctx, `
+		INSERT INTO email_verifications (id, user_id, token, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, uuid.New(), userID, hashToken(token), now.Add(EmailVerificationExpiry), now)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Verify marks the email address of the token's user as verified and
+// invalidates all of the user's verification tokens
+func (r *EmailVerificationRepository) Verify(ctx context.Context, token string) (uuid.UUID, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID uuid.UUID
+	err = tx.QueryRow(ctx, `
+		SELECT user_id FROM email_verifications WHERE token = $1 AND expires_at > $2
+	`, hashToken(token), time.Now()).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET email_verified = true, updated_at = $1 WHERE id = $2`, time.Now(), userID); err != nil {
+		return uuid.Nil, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM email_verifications WHERE user_id = $1`, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	return userID, tx.Commit(ctx)
+}
+
+func (r *EmailVerificationRepository) CleanupExpired(ctx context.Context) error {
+	_, err := r.pool.Exec(ctx, `DELETE FROM email_verifications WHERE expires_at < $1`, time.Now())
+	return err
+}
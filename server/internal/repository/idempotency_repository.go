@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was used for a different request")
+	ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is still in progress")
+)
+
+// idempotencyClaimTimeout frees keys whose request never completed (e.g. crash)
+const idempotencyClaimTimeout = 2 * time.Minute
+
+type IdempotencyRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewIdempotencyRepository(pool *pgxpool.Pool) *IdempotencyRepository {
+	return &IdempotencyRepository{pool: pool}
+}
+
+// Claim reserves the key for a new request. If the key was already completed
+// for the same request, the stored record is returned and must be replayed.
+// A nil record means the caller owns the key and must Complete or Release it.
+func (r *IdempotencyRepository) Claim(ctx context.Context, userID uuid.UUID, key, requestHash string, now time.Time) (*models.IdempotencyRecord, error) {
+	var claimed string
+	err := r.pool.QueryRow(ctx, `
+		INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, idempotency_key) DO UPDATE
+		SET created_at = EXCLUDED.created_at
+		WHERE idempotency_keys.status_code IS NULL
+		  AND idempotency_keys.request_hash = EXCLUDED.request_hash
+		  AND idempotency_keys.created_at < $5
+		RETURNING idempotency_key
+	`, userID, key, requestHash, now, now.Add(-idempotencyClaimTimeout)).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	// Key exists already
+	record := &models.IdempotencyRecord{UserID: userID, Key: key}
+	err = r.pool.QueryRow(ctx, `
+		SELECT request_hash, status_code, content_type, response, created_at
+		FROM idempotency_keys
+		WHERE user_id = $1 AND idempotency_key = $2
+	`, userID, key).Scan(&record.RequestHash, &record.StatusCode, &record.ContentType, &record.Response, &record.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Released or cleaned up in the meantime
+		return r.Claim(ctx, userID, key, requestHash, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if record.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if record.StatusCode == nil {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return record, nil
+}
+
+// Complete stores the response of a claimed key for later replays
+func (r *IdempotencyRepository) Complete(ctx context.Context, userID uuid.UUID, key string, statusCode int, contentType string, response []byte) error {
+	_, err := r.pool.Exec(ctx, `
+		UPDATE idempotency_keys
+		SET status_code = $3, content_type = $4, response = $5
+		WHERE user_id = $1 AND idempotency_key = $2
+	`, userID, key, statusCode, contentType, response)
+	return err
+}
+
+// Release drops a claimed key without response, so the request can be retried
+func (r *IdempotencyRepository) Release(ctx context.Context, userID uuid.UUID, key string) error {
+	_, err := r.pool.Exec(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND idempotency_key = $2 AND status_code IS NULL
+	`, userID, key)
+	return err
+}
+
+// CleanupExpired removes stored responses older than the cutoff
+func (r *IdempotencyRepository) CleanupExpired(ctx context.Context, cutoff time.Time) error {
+	_, err := r.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, cutoff)
+	return err
+}
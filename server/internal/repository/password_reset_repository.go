@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrResetTokenInvalid     = errors.New("password reset token invalid, used or expired")
+	ErrTooManyPasswordResets = errors.New("too many password reset mails")
+)
+
+const (
+	PasswordResetExpiry     = time.Hour
+	MaxPasswordResetMails   = 3 // Per user within PasswordResetMailWindow
+	PasswordResetMailWindow = time.Hour
+	passwordResetTokenBytes = 32
+)
+
+type PasswordResetRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPasswordResetRepository(pool *pgxpool.Pool) *PasswordResetRepository {
+	return &PasswordResetRepository{pool: pool}
+}
+
+// Create issues a reset token for a user and returns it. Only its hash is
+// stored. Returns ErrTooManyPasswordResets if the user already got
+// MaxPasswordResetMails within PasswordResetMailWindow.
+func (r *PasswordResetRepository) Create(ctx context.Context, userID uuid.UUID) (string, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// Count and insert under one lock, so parallel requests cannot exceed the limit
+	if err := lockUserMails(ctx, tx, userID); err != nil {
+		return "", err
+	}
+
+	var recent int
+	err = tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM password_resets WHERE user_id = $1 AND created_at > $2
+	`, userID, time.Now().Add(-PasswordResetMailWindow)).Scan(&recent)
+	if err != nil {
+		return "", err
+	}
+	if recent >= MaxPasswordResetMails {
+		return "", ErrTooManyPasswordResets
+	}
+
+	b := make([]byte, passwordResetTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	now := time.Now()
+	_, err = tx.Exec(ctx, `
+		INSERT INTO password_resets (id, user_id, token, expires_at, used, created_at)
+		VALUES ($1, $2, $3, $4, false, $5)
+	`, uuid.New(), userID, hashToken(token), now.Add(PasswordResetExpiry), now)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Valid reports whether a token can still be used, without using it
+func (r *PasswordResetRepository) Valid(ctx context.Context, token string) (bool, error) {
+	var valid bool
+	err := r.pool.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM password_resets WHERE token = $1 AND NOT used AND expires_at > $2)
+	`, hashToken(token), time.Now()).Scan(&valid)
+	return valid, err
+}
+
+// Reset sets a new password hash for the token's user. All of the user's
+// reset tokens are used up and all refresh tokens revoked, so every device
+// has to log in again with the new password.
+func (r *PasswordResetRepository) Reset(ctx context.Context, token, passwordHash string) (uuid.UUID, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	var userID uuid.UUID
+	err = tx.QueryRow(ctx, `
+		SELECT user_id FROM password_resets
+		WHERE token = $1 AND NOT used AND expires_at > $2
+		FOR UPDATE
+	`, hashToken(token), now).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET password_hash = $1, updated_at = $2 WHERE id = $3`, passwordHash, now, userID); err != nil {
+		return uuid.Nil, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE password_resets SET used = true WHERE user_id = $1 AND NOT used`, userID); err != nil {
+		return uuid.Nil, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET revoked = true WHERE user_id = $1`, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	return userID, tx.Commit(ctx)
+}
+
+// CleanupExpired removes expired tokens. Used ones stay until they expire,
+// so the rate limit still counts them.
+func (r *PasswordResetRepository) CleanupExpired(ctx context.Context) error {
+	_, err := r.pool.Exec(ctx, `DELETE FROM password_resets WHERE expires_at < $1`, time.Now())
+	return err
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+// syncEventsChannel is the Postgres NOTIFY channel for committed sync writes
+const syncEventsChannel = "sync_changes"
+
+// SyncEvents fans out committed sync changes to subscribers on this instance.
+// Changes arrive via Postgres LISTEN/NOTIFY, so writes handled by other API
+// instances are delivered as well.
+type SyncEvents struct {
+	pool *pgxpool.Pool
+
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[chan models.SyncEvent]struct{}
+}
+
+func NewSyncEvents(pool *pgxpool.Pool) *SyncEvents {
+	return &SyncEvents{
+		pool: pool,
+		subs: make(map[uuid.UUID]map[chan models.SyncEvent]struct{}),
+	}
+}
+
+// Run listens for notifications until ctx is cancelled, reconnecting on errors
+func (e *SyncEvents) Run(ctx context.Context) {
+	for {
+		err := e.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Sync event listener stopped: %v (reconnecting)", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (e *SyncEvents) listen(ctx context.Context) error {
+	poolConn, err := e.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// Take the connection out of the pool; it stays in LISTEN mode
+	conn := poolConn.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+syncEventsChannel); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var event models.SyncEvent
+		if err := json.Unmarshal([]byte(n.Payload), &event); err != nil {
+			log.Printf("Invalid sync event payload: %v", err)
+			continue
+		}
+		e.dispatch(event)
+	}
+}
+
+// Subscribe returns a channel receiving all sync events of a user and a
+// function to cancel the subscription.
+func (e *SyncEvents) Subscribe(userID uuid.UUID) (<-chan models.SyncEvent, func()) {
+	ch := make(chan models.SyncEvent, 16)
+
+	e.mu.Lock()
+	if e.subs[userID] == nil {
+		e.subs[userID] = make(map[chan models.SyncEvent]struct{})
+	}
+	e.subs[userID][ch] = struct{}{}
+	e.mu.Unlock()
+
+	return ch, func() {
+		e.mu.Lock()
+		delete(e.subs[userID], ch)
+		if len(e.subs[userID]) == 0 {
+			delete(e.subs, userID)
+		}
+		e.mu.Unlock()
+	}
+}
+
+func (e *SyncEvents) dispatch(event models.SyncEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ch := range e.subs[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber; it will catch up with the next event's cursor
+		}
+	}
+}
+
+// notifyChange announces a change that is not an encrypted item write (e.g.
+// the running timer) to the user's other devices once tx commits
+func notifyChange(ctx context.Context, tx pgx.Tx, userID, deviceID uuid.UUID, dataType string) error {
+	payload, err := json.Marshal(models.SyncEvent{
+		UserID:    userID,
+		DeviceID:  deviceID,
+		DataTypes: []string{dataType},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `SELECT pg_notify($1, $2)`, syncEventsChannel, string(payload))
+	return err
+}
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+// ErrKeyMismatch is returned when an archive was encrypted with a different
+// key than the one the account is set up with
+var ErrKeyMismatch = errors.New("archive key does not match account key")
+
+// ExportVault reads the key info and all live items of a user from a single
+// snapshot. onKey is called once before the items are passed to onItem.
+func (r *SyncRepository) ExportVault(ctx context.Context, userID uuid.UUID, onKey func(keySalt, keyVerificationHash []byte) error, onItem func(models.VaultItem) error) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var keySalt, keyVerificationHash []byte
+	err = tx.QueryRow(ctx, `
+		SELECT key_salt, key_verification_hash FROM users WHERE id = $1
+	`, userID).Scan(&keySalt, &keyVerificationHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := onKey(keySalt, keyVerificationHash); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT data_type, local_id, encrypted_blob, nonce, schema_version, created_at, updated_at
+		FROM encrypted_data
+		WHERE user_id = $1 AND deleted_at IS NULL
+		ORDER BY seq
+	`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.VaultItem
+		err := rows.Scan(&item.DataType, &item.LocalID, &item.EncryptedBlob, &item.Nonce, &item.SchemaVersion, &item.CreatedAt, &item.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		if err := onItem(item); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ImportVault writes the items of an archive into the user's account. An
+// account without key info takes over the archive's key; otherwise the keys
+// must match. The mode decides what happens to items that exist already.
+// Items are checked and written like a push, so the same errors apply.
+func (r *SyncRepository) ImportVault(ctx context.Context, userID, deviceID uuid.UUID, archive *models.VaultArchive, mode string) (*models.ImportResponse, error) {
+	started := time.Now()
+	summary := &models.ImportResponse{Mode: mode}
+	writes := make([]itemWrite, 0, len(archive.Items))
+	inArchive := make(map[string]bool, len(archive.Items))
+	for _, item := range archive.Items {
+		writes = append(writes, itemWrite{
+			DataType:      item.DataType,
+			LocalID:       item.LocalID,
+			Blob:          item.EncryptedBlob,
+			Nonce:         item.Nonce,
+			SchemaVersion: item.SchemaVersion,
+		})
+		inArchive[itemKey(item.DataType, item.LocalID)] = true
+	}
+	if err := r.checkWrites(writes, newWriteResults(writes)); err != nil {
+		return nil, err
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return nil, err
+	}
+
+	var keySalt, keyVerificationHash []byte
+	var rotating bool
+	err = tx.QueryRow(ctx, `
+		SELECT key_salt, key_verification_hash,
+		       EXISTS (SELECT 1 FROM key_rotations WHERE user_id = users.id)
+		FROM users WHERE id = $1 FOR UPDATE
+	`, userID).Scan(&keySalt, &keyVerificationHash, &rotating)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Archive items are encrypted with the account key, not a rotation target
+	if rotating {
+		return nil, ErrRotationInProgress
+	}
+	if keySalt == nil {
+		_, err = tx.Exec(ctx, `
+			UPDATE users SET key_salt = $1, key_verification_hash = $2, updated_at = $3 WHERE id = $4
+		`, archive.KeySalt, archive.KeyVerificationHash, time.Now(), userID)
+		if err != nil {
+			return nil, err
+		}
+		summary.KeyImported = true
+	} else if !bytes.Equal(keySalt, archive.KeySalt) || !bytes.Equal(keyVerificationHash, archive.KeyVerificationHash) {
+		return nil, ErrKeyMismatch
+	}
+
+	existing, err := activeItemKeys(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case models.ImportModeMerge:
+		// Keep live items; deleted ones are restored from the archive
+		live := make(map[string]bool, len(existing))
+		for _, item := range existing {
+			live[itemKey(item.DataType, item.LocalID)] = true
+		}
+		kept := writes[:0]
+		for _, w := range writes {
+			if live[itemKey(w.DataType, w.LocalID)] {
+				summary.Skipped++
+				continue
+			}
+			kept = append(kept, w)
+		}
+		writes = kept
+	case models.ImportModeReplace:
+		// Delete everything the archive does not contain
+		for _, item := range existing {
+			if !inArchive[itemKey(item.DataType, item.LocalID)] {
+				writes = append(writes, itemWrite{DataType: item.DataType, LocalID: item.LocalID, Deleted: true})
+			}
+		}
+	}
+
+	results := newWriteResults(writes)
+	if err := r.applyGuarded(ctx, tx, userID, deviceID, "import", started, writes, results); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, w := range writes {
+		if w.Deleted {
+			summary.Deleted++
+		} else {
+			summary.Imported++
+		}
+	}
+
+	return summary, nil
+}
+
+// newWriteResults returns one result with status ok per write
+func newWriteResults(writes []itemWrite) []models.SyncPushResult {
+	results := make([]models.SyncPushResult, len(writes))
+	for i, w := range writes {
+		results[i] = models.SyncPushResult{Index: i, DataType: w.DataType, LocalID: w.LocalID, Status: models.SyncItemStatusOK}
+	}
+	return results
+}
+
+// activeItemKeys lists data type and local ID of all live items of a user
+func activeItemKeys(ctx context.Context, tx pgx.Tx, userID uuid.UUID) ([]models.VaultItem, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT data_type, local_id FROM encrypted_data WHERE user_id = $1 AND deleted_at IS NULL
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.VaultItem
+	for rows.Next() {
+		var item models.VaultItem
+		if err := rows.Scan(&item.DataType, &item.LocalID); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
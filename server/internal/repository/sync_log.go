@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+// execer is satisfied by both the pool and a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// syncLogEntry collects what one sync request transferred. It is stored as
+// one sync_log row per data type.
+type syncLogEntry struct {
+	action  string
+	started time.Time
+	types   map[string]*syncLogCounts
+}
+
+type syncLogCounts struct {
+	upserts int
+	deletes int
+	bytes   int64
+}
+
+func newSyncLogEntry(action string, started time.Time) *syncLogEntry {
+	return &syncLogEntry{action: action, started: started, types: make(map[string]*syncLogCounts)}
+}
+
+// add counts one item; size is the length of its blob and nonce
+func (e *syncLogEntry) add(dataType string, deleted bool, size int) {
+	counts, ok := e.types[dataType]
+	if !ok {
+		counts = &syncLogCounts{}
+		e.types[dataType] = counts
+	}
+	if deleted {
+		counts.deletes++
+	} else {
+		counts.upserts++
+	}
+	counts.bytes += int64(size)
+}
+
+// insert writes the entry. A request without items still gets a row
+// (data_type NULL) so that it shows up in the log.
+func (e *syncLogEntry) insert(ctx context.Context, q execer, userID, deviceID, requestID uuid.UUID, now time.Time) error {
+	dataTypes := make([]string, 0, len(e.types))
+	for dataType := range e.types {
+		dataTypes = append(dataTypes, dataType)
+	}
+	sort.Strings(dataTypes)
+	if len(dataTypes) == 0 {
+		dataTypes = append(dataTypes, "")
+	}
+
+	upserts := make([]int, len(dataTypes))
+	deletes := make([]int, len(dataTypes))
+	bytes := make([]int64, len(dataTypes))
+	for i, dataType := range dataTypes {
+		if counts, ok := e.types[dataType]; ok {
+			upserts[i], deletes[i], bytes[i] = counts.upserts, counts.deletes, counts.bytes
+		}
+	}
+
+	_, err := q.Exec(ctx, `
+		INSERT INTO sync_log (id, user_id, device_id, request_id, action, data_type, items_count, upserts, deletes, bytes, duration_ms, created_at)
+		SELECT gen_random_uuid(), $1, $2, $3, $4, NULLIF(t.data_type, ''), t.upserts + t.deletes, t.upserts, t.deletes, t.bytes, $5, $6
+		FROM unnest($7::text[], $8::int[], $9::int[], $10::bigint[]) AS t(data_type, upserts, deletes, bytes)
+	`, userID, deviceID, requestID, e.action, now.Sub(e.started).Milliseconds(), now, dataTypes, upserts, deletes, bytes)
+	return err
+}
+
+// LogPull records the items a device pulled. started is when the pull
+// request arrived.
+func (r *SyncRepository) LogPull(ctx context.Context, userID, deviceID uuid.UUID, items []models.SyncPullItem, started time.Time) error {
+	entry := newSyncLogEntry("pull", started)
+	for _, item := range items {
+		entry.add(item.DataType, item.Deleted, len(item.EncryptedBlob)+len(item.Nonce))
+	}
+	return entry.insert(ctx, r.pool, userID, deviceID, uuid.New(), time.Now())
+}
+
+// ListSyncLog returns a user's sync log entries, newest first. Paging is by
+// keyset on (created_at, id), so entries written meanwhile don't shift pages.
+func (r *SyncRepository) ListSyncLog(ctx context.Context, userID uuid.UUID, filter models.SyncLogFilter, limit int) ([]models.SyncLog, error) {
+	rows, err := r.pool.Query(ctx, `
+		SELECT l.id, l.request_id, l.device_id, COALESCE(d.device_name, ''), l.action, COALESCE(l.data_type, ''), l.items_count,
+		       l.upserts, l.deletes, l.bytes, l.duration_ms, l.created_at
+		FROM sync_log l
+		LEFT JOIN devices d ON d.id = l.device_id
+		WHERE l.user_id = $1
+		  AND ($2::uuid IS NULL OR l.device_id = $2)
+		  AND ($3 = '' OR l.action = $3)
+		  AND ($4 = '' OR l.data_type = $4)
+		  AND ($5::timestamptz IS NULL OR l.created_at >= $5)
+		  AND ($6::timestamptz IS NULL OR l.created_at < $6)
+		  AND ($7::timestamptz IS NULL OR (l.created_at, l.id) < ($7, $8::uuid))
+		ORDER BY l.created_at DESC, l.id DESC
+		LIMIT $9
+	`, userID, filter.DeviceID, filter.Action, filter.DataType, filter.From, filter.To, filter.BeforeTime, filter.BeforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.SyncLog
+	for rows.Next() {
+		entry := models.SyncLog{UserID: userID}
+		if err := rows.Scan(&entry.ID, &entry.RequestID, &entry.DeviceID, &entry.DeviceName, &entry.Action, &entry.DataType, &entry.ItemsCount,
+			&entry.Upserts, &entry.Deletes, &entry.Bytes, &entry.DurationMs, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// SyncLogDaily sums the filtered log per day and action, newest day first.
+// Days are cut in the given IANA time zone. Entries counts requests, not
+// the per-data-type rows they were logged as.
+func (r *SyncRepository) SyncLogDaily(ctx context.Context, userID uuid.UUID, filter models.SyncLogFilter, timeZone string) ([]models.SyncLogDay, error) {
+	rows, err := r.pool.Query(ctx, `
+		SELECT to_char(created_at AT TIME ZONE $7, 'YYYY-MM-DD') AS day, action, COUNT(DISTINCT COALESCE(request_id, id)),
+		       COALESCE(SUM(items_count), 0), COALESCE(SUM(upserts), 0), COALESCE(SUM(deletes), 0), COALESCE(SUM(bytes), 0)::bigint
+		FROM sync_log
+		WHERE user_id = $1
+		  AND ($2::uuid IS NULL OR device_id = $2)
+		  AND ($3 = '' OR action = $3)
+		  AND ($4 = '' OR data_type = $4)
+		  AND ($5::timestamptz IS NULL OR created_at >= $5)
+		  AND ($6::timestamptz IS NULL OR created_at < $6)
+		GROUP BY day, action
+		ORDER BY day DESC, action
+	`, userID, filter.DeviceID, filter.Action, filter.DataType, filter.From, filter.To, timeZone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []models.SyncLogDay
+	for rows.Next() {
+		var day models.SyncLogDay
+		if err := rows.Scan(&day.Date, &day.Action, &day.Entries, &day.ItemsCount, &day.Upserts, &day.Deletes, &day.Bytes); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+
+	return days, rows.Err()
+}
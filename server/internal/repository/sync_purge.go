@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PurgeTombstones permanently removes items of all users that were soft-deleted
+// before the cutoff and advances each affected user's purge horizon.
+func (r *SyncRepository) PurgeTombstones(ctx context.Context, cutoff time.Time) (int64, error) {
+	var purged int64
+	err := r.pool.QueryRow(ctx, `
+		WITH purged AS (
+			DELETE FROM encrypted_data
+			WHERE deleted_at < $1
+			RETURNING user_id, seq
+		), horizon AS (
+			UPDATE sync_sequences s
+			SET purged_seq = GREATEST(s.purged_seq, p.max_seq)
+			FROM (SELECT user_id, MAX(seq) AS max_seq FROM purged GROUP BY user_id) p
+			WHERE s.user_id = p.user_id
+		)
+		SELECT COUNT(*) FROM purged
+	`, cutoff).Scan(&purged)
+	return purged, err
+}
+
+// PurgeDeletedItems permanently removes all soft-deleted items of a user,
+// including their revision history.
+func (r *SyncRepository) PurgeDeletedItems(ctx context.Context, userID, deviceID uuid.UUID) (int64, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the user's sequence so no push interleaves with the purge
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM encrypted_data_revisions r
+		USING encrypted_data e
+		WHERE e.user_id = $1 AND e.deleted_at IS NOT NULL
+		  AND r.user_id = e.user_id AND r.data_type = e.data_type AND r.local_id = e.local_id
+	`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	var maxSeq *int64
+	err = tx.QueryRow(ctx, `
+		WITH purged AS (
+			DELETE FROM encrypted_data
+			WHERE user_id = $1 AND deleted_at IS NOT NULL
+			RETURNING seq
+		)
+		SELECT COUNT(*), MAX(seq) FROM purged
+	`, userID).Scan(&purged, &maxSeq)
+	if err != nil {
+		return 0, err
+	}
+
+	if maxSeq != nil {
+		_, err = tx.Exec(ctx, `
+			UPDATE sync_sequences SET purged_seq = GREATEST(purged_seq, $1) WHERE user_id = $2
+		`, *maxSeq, userID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO sync_log (id, user_id, device_id, action, data_type, items_count, created_at)
+		VALUES ($1, $2, $3, 'purge', NULL, $4, $5)
+	`, uuid.New(), userID, deviceID, purged, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit(ctx)
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+// ErrQuotaExceeded is returned when a push would exceed the user's storage
+// quota or contains an item larger than the maximum item size
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// rowQuerier is implemented by both the pool and transactions
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// GetStorageUsage returns the stored bytes and items of a user together with
+// the limits that apply to them
+func (r *SyncRepository) GetStorageUsage(ctx context.Context, userID uuid.UUID) (*models.StorageUsage, error) {
+	return r.storageUsage(ctx, r.pool, userID)
+}
+
+func (r *SyncRepository) storageUsage(ctx context.Context, q rowQuerier, userID uuid.UUID) (*models.StorageUsage, error) {
+	usage := &models.StorageUsage{MaxItemBytes: r.limits.MaxItemBytes}
+	var quotaBytes *int64
+	var quotaItems *int
+
+	// Only live items count; tombstones are purged separately
+	err := q.QueryRow(ctx, `
+		SELECT u.quota_bytes, u.quota_items,
+		       COALESCE(SUM(octet_length(e.encrypted_blob) + octet_length(e.nonce)), 0),
+		       COUNT(e.id),
+		       (SELECT COALESCE(SUM(a.size), 0)::bigint FROM attachments a WHERE a.user_id = u.id)
+		FROM users u
+		LEFT JOIN encrypted_data e ON e.user_id = u.id AND e.deleted_at IS NULL
+		WHERE u.id = $1
+		GROUP BY u.id
+	`, userID).Scan(&quotaBytes, &quotaItems, &usage.UsedBytes, &usage.UsedItems, &usage.AttachmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	usage.UsedBytes += usage.AttachmentBytes
+
+	usage.QuotaBytes = r.limits.UserBytes
+	if quotaBytes != nil {
+		usage.QuotaBytes = *quotaBytes
+	}
+	usage.QuotaItems = r.limits.UserItems
+	if quotaItems != nil {
+		usage.QuotaItems = *quotaItems
+	}
+
+	return usage, nil
+}
+
+// checkQuota compares the usage after a write with the usage before it.
+// Writes that do not grow an over-quota account (e.g. deletions) stay allowed.
+func checkQuota(before, after *models.StorageUsage) error {
+	if after.QuotaBytes > 0 && after.UsedBytes > after.QuotaBytes && after.UsedBytes > before.UsedBytes {
+		return ErrQuotaExceeded
+	}
+	if after.QuotaItems > 0 && after.UsedItems > after.QuotaItems && after.UsedItems > before.UsedItems {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// limitedDataTypes returns the data types with an item limit that the writes
+// add or update items of
+func limitedDataTypes(writes []itemWrite) []string {
+	seen := make(map[string]bool)
+	var dataTypes []string
+	for _, w := range writes {
+		spec, ok := models.LookupDataType(w.DataType)
+		if w.Deleted || !ok || spec.ItemLimit() == 0 || seen[w.DataType] {
+			continue
+		}
+		seen[w.DataType] = true
+		dataTypes = append(dataTypes, w.DataType)
+	}
+	return dataTypes
+}
+
+// countLiveItems counts the user's items that are not deleted per data type
+func countLiveItems(ctx context.Context, tx pgx.Tx, userID uuid.UUID, dataTypes []string) (map[string]int, error) {
+	counts := make(map[string]int)
+	if len(dataTypes) == 0 {
+		return counts, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT data_type, COUNT(*)
+		FROM encrypted_data
+		WHERE user_id = $1 AND data_type = ANY($2::text[]) AND deleted_at IS NULL
+		GROUP BY data_type
+	`, userID, dataTypes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var dataType string
+		var count int
+		if err := rows.Scan(&dataType, &count); err != nil {
+			return nil, err
+		}
+		counts[dataType] = count
+	}
+	return counts, rows.Err()
+}
+
+// checkItemLimits fails the written items of every data type that grew past
+// its item limit. Types that were already over the limit may still be
+// updated as long as the push adds no items.
+func checkItemLimits(before, after map[string]int, writes []itemWrite, results []models.SyncPushResult) error {
+	rejected := false
+	for i, w := range writes {
+		spec, _ := models.LookupDataType(w.DataType)
+		limit := spec.ItemLimit()
+		if w.Deleted || limit == 0 || after[w.DataType] <= limit || after[w.DataType] <= before[w.DataType] {
+			continue
+		}
+		if results[i].Status != models.SyncItemStatusOK {
+			continue
+		}
+		results[i].Status = models.SyncItemStatusFailed
+		results[i].Error = fmt.Sprintf("%s allows at most %d items", w.DataType, limit)
+		rejected = true
+	}
+	if rejected {
+		return ErrPushRejected
+	}
+	return nil
+}
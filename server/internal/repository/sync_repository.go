@@ -2,113 +2,521 @@ package repository
 
 import (
 	"context"
-	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/sprobst76/vibedtracker-server/internal/models"
 )
 
 type SyncRepository struct {
-	pool *pgxpool.Pool
+	pool   *pgxpool.Pool
+	limits models.StorageLimits
 }
 
-func NewSyncRepository(pool *pgxpool.Pool) *SyncRepository {
-	return &SyncRepository{pool: pool}
+func NewSyncRepository(pool *pgxpool.Pool, limits models.StorageLimits) *SyncRepository {
+	return &SyncRepository{pool: pool, limits: limits}
 }
 
-func (r *SyncRepository) PushItems(ctx context.Context, userID, deviceID uuid.UUID, items []models.SyncPushItem) error {
-	for _, item := range items {
-		blob, err := base64.StdEncoding.DecodeString(item.EncryptedBlob)
-		if err != nil {
-			return err
+// ErrPushRejected is returned when a push was not written because at least
+// one item was invalid. The per-item results describe which ones.
+var ErrPushRejected = errors.New("sync push rejected")
+
+// ErrResyncRequired is returned when a pull cursor predates purged tombstones,
+// so the device may have missed deletions and must pull from the beginning.
+var ErrResyncRequired = errors.New("full resync required")
+
+// itemWrite is a decoded item ready to be written to encrypted_data
+type itemWrite struct {
+	DataType      string
+	LocalID       string
+	Blob          []byte
+	Nonce         []byte
+	SchemaVersion int
+	KeyGeneration int
+	Deleted       bool
+	BaseRevision  *int64
+	Attachments   []string // nil keeps the current references
+}
+
+// PushItems writes all items in a single transaction. Either every accepted
+// item is written or none is; the returned results always have one entry per
+// item. Items whose base revision is stale are reported as conflicts and left
+// untouched without failing the rest of the push. ErrQuotaExceeded is returned
+// if an item is too large or the push would exceed the user's quota;
+// ErrPushRejected if an item is invalid or a data type would exceed its
+// item limit.
+func (r *SyncRepository) PushItems(ctx context.Context, userID, deviceID uuid.UUID, items []models.SyncPushItem) ([]models.SyncPushResult, error) {
+	started := time.Now()
+	results := make([]models.SyncPushResult, len(items))
+	writes := make([]itemWrite, len(items))
+	for i, item := range items {
+		results[i] = models.SyncPushResult{
+			Index:    i,
+			DataType: item.DataType,
+			LocalID:  item.LocalID,
+			Status:   models.SyncItemStatusOK,
 		}
-		nonce, err := base64.StdEncoding.DecodeString(item.Nonce)
-		if err != nil {
-			return err
+		writes[i] = itemWrite{
+			DataType:      item.DataType,
+			LocalID:       item.LocalID,
+			SchemaVersion: item.SchemaVersion,
+			Deleted:       item.Deleted,
+			BaseRevision:  item.BaseRevision,
+		}
+		if !item.Deleted {
+			writes[i].Blob = item.EncryptedBlob
+			writes[i].Nonce = item.Nonce
+			writes[i].Attachments = item.Attachments
+		}
+	}
+	if err := r.checkWrites(writes, results); err != nil {
+		return results, err
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the user's sequence first so the usage cannot change underneath us
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return nil, err
+	}
+	if err := r.applyGuarded(ctx, tx, userID, deviceID, "push", started, writes, results); err != nil {
+		return results, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		markSkipped(results)
+		return results, err
+	}
+
+	return results, nil
+}
+
+// checkWrites validates decoded items against the data type registry and the
+// size limits before any of them is written. Failed items are marked in
+// results; the rest are marked skipped and ErrPushRejected or
+// ErrQuotaExceeded (an item is too large) is returned.
+func (r *SyncRepository) checkWrites(writes []itemWrite, results []models.SyncPushResult) error {
+	rejected := false
+	tooLarge := false
+
+	for i, w := range writes {
+		// Deletes of unknown types are allowed, so orphaned items can be removed
+		if w.Deleted {
+			continue
+		}
+		spec, ok := models.LookupDataType(w.DataType)
+		if !ok {
+			results[i].Status = models.SyncItemStatusFailed
+			results[i].Error = "unknown data_type " + w.DataType
+			rejected = true
+			continue
+		}
+		if err := validateAttachmentRefs(w.Attachments); err != nil {
+			results[i].Status = models.SyncItemStatusFailed
+			results[i].Error = err.Error()
+			rejected = true
+			continue
+		}
+		if len(w.Blob) == 0 {
+			results[i].Status = models.SyncItemStatusFailed
+			results[i].Error = "missing encrypted_blob"
+			rejected = true
+			continue
+		}
+		if len(w.Nonce) == 0 {
+			results[i].Status = models.SyncItemStatusFailed
+			results[i].Error = "missing nonce"
+			rejected = true
+			continue
+		}
+		if limit := spec.BlobLimit(r.limits.MaxItemBytes); limit > 0 && len(w.Blob) > limit {
+			results[i].Status = models.SyncItemStatusFailed
+			results[i].Error = fmt.Sprintf("encrypted_blob exceeds maximum size of %d bytes for %s", limit, w.DataType)
+			tooLarge = true
+		}
+	}
+
+	if rejected {
+		markSkipped(results)
+		return ErrPushRejected
+	}
+	if tooLarge {
+		markSkipped(results)
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// applyGuarded applies writes with the checks every client write goes
+// through: the key rotation state, attachment references, per-type item
+// limits and the storage quota. The user's sequence must already be reserved
+// in tx. Writes with a key generation set (restored versions) must match the
+// generation the device writes with, or ErrStaleKeyGeneration is returned.
+// On error results are marked and tx must be rolled back.
+func (r *SyncRepository) applyGuarded(ctx context.Context, tx pgx.Tx, userID, deviceID uuid.UUID, action string, started time.Time, writes []itemWrite, results []models.SyncPushResult) error {
+	keyGeneration, err := writeKeyGeneration(ctx, tx, userID, deviceID)
+	if err != nil {
+		markSkipped(results)
+		return err
+	}
+	stale := false
+	for i := range writes {
+		if !writes[i].Deleted && writes[i].KeyGeneration != 0 && writes[i].KeyGeneration != keyGeneration {
+			results[i].Status = models.SyncItemStatusFailed
+			results[i].Error = ErrStaleKeyGeneration.Error()
+			stale = true
+		}
+		writes[i].KeyGeneration = keyGeneration
+	}
+	if stale {
+		markSkipped(results)
+		return ErrStaleKeyGeneration
+	}
+	if err := checkAttachmentRefs(ctx, tx, userID, writes, results); err != nil {
+		markSkipped(results)
+		return err
+	}
+	before, err := r.storageUsage(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	limited := limitedDataTypes(writes)
+	countsBefore, err := countLiveItems(ctx, tx, userID, limited)
+	if err != nil {
+		return err
+	}
+
+	if err := r.applyWrites(ctx, tx, userID, deviceID, action, started, writes, results); err != nil {
+		return err
+	}
+
+	countsAfter, err := countLiveItems(ctx, tx, userID, limited)
+	if err != nil {
+		markSkipped(results)
+		return err
+	}
+	if err := checkItemLimits(countsBefore, countsAfter, writes, results); err != nil {
+		markSkipped(results)
+		return err
+	}
+
+	after, err := r.storageUsage(ctx, tx, userID)
+	if err != nil {
+		markSkipped(results)
+		return err
+	}
+	if err := checkQuota(before, after); err != nil {
+		markSkipped(results)
+		return err
+	}
+	return nil
+}
+
+// applyWrites writes decoded items inside tx, archiving the version each
+// write replaces, and logs the given sync action; started is when the
+// operation began. results must have one entry per write with status ok;
+// it is updated in place.
+func (r *SyncRepository) applyWrites(ctx context.Context, tx pgx.Tx, userID, deviceID uuid.UUID, action string, started time.Time, writes []itemWrite, results []models.SyncPushResult) error {
+	// Reserve one change sequence per item; this also serializes writes per user
+	lastSeq, err := reserveSeqs(ctx, tx, userID, len(writes))
+	if err != nil {
+		return err
+	}
+	firstSeq := lastSeq - int64(len(writes)) + 1
+
+	// Items carrying a base revision are only written if the server still has that revision
+	current, err := loadCurrentItems(ctx, tx, userID, writes)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	batch := &pgx.Batch{}
+	var queued []int
+	written := newSyncLogEntry(action, started)
+	conflicts := newSyncLogEntry("conflict", started)
+	for i, w := range writes {
+		if server, ok := current[itemKey(w.DataType, w.LocalID)]; ok && w.BaseRevision != nil && server.Seq != *w.BaseRevision {
+			results[i].Status = models.SyncItemStatusConflict
+			results[i].Server = &server
+			conflicts.add(w.DataType, w.Deleted, 0)
+			continue
 		}
+		written.add(w.DataType, w.Deleted, len(w.Blob)+len(w.Nonce))
 
-		schemaVersion := item.SchemaVersion
+		schemaVersion := w.SchemaVersion
 		if schemaVersion == 0 {
 			schemaVersion = 1
 		}
+		keyGeneration := w.KeyGeneration
+		if keyGeneration == 0 {
+			keyGeneration = 1
+		}
+		seq := firstSeq + int64(i)
 
-		if item.Deleted {
-			// Soft delete
-			_, err = r.pool.Exec(ctx, `
+		// Keep the version being replaced in the revision history
+		batch.Queue(`
+			INSERT INTO encrypted_data_revisions (id, user_id, device_id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, attachments, seq, valid_from, deleted, superseded_at)
+			SELECT $1, user_id, device_id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, attachments, seq, updated_at, deleted_at IS NOT NULL, $2
+			FROM encrypted_data
+			WHERE user_id = $3 AND data_type = $4 AND local_id = $5
+		`, uuid.New(), now, userID, w.DataType, w.LocalID)
+
+		if w.Deleted {
+			// Soft delete; the revision keeps the attachment references
+			batch.Queue(`
 				UPDATE encrypted_data
-				SET deleted_at = $1, updated_at = $1, device_id = $2
-				WHERE user_id = $3 AND data_type = $4 AND local_id = $5
-			`, time.Now(), deviceID, userID, item.DataType, item.LocalID)
+				SET deleted_at = $1, updated_at = $1, device_id = $2, seq = $3, attachments = '{}'
+				WHERE user_id = $4 AND data_type = $5 AND local_id = $6
+			`, now, deviceID, seq, userID, w.DataType, w.LocalID)
 		} else {
 			// Upsert
-			_, err = r.pool.Exec(ctx, `
-				INSERT INTO encrypted_data (id, user_id, device_id, data_type, local_id, encrypted_blob, nonce, schema_version, created_at, updated_at)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9)
+			batch.Queue(`
+				INSERT INTO encrypted_data (id, user_id, device_id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, attachments, seq, created_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE($12::text[], '{}'), $10, $11, $11)
 				ON CONFLICT (user_id, data_type, local_id)
-				DO UPDATE SET encrypted_blob = $6, nonce = $7, schema_version = $8, device_id = $3, updated_at = $9, deleted_at = NULL
-			`, uuid.New(), userID, deviceID, item.DataType, item.LocalID, blob, nonce, schemaVersion, time.Now())
+				DO UPDATE SET encrypted_blob = $6, nonce = $7, schema_version = $8, key_generation = $9, seq = $10, device_id = $3, updated_at = $11, deleted_at = NULL, attachments = COALESCE($12::text[], encrypted_data.attachments)
+			`, uuid.New(), userID, deviceID, w.DataType, w.LocalID, w.Blob, w.Nonce, schemaVersion, keyGeneration, seq, now, w.Attachments)
 		}
+		queued = append(queued, i)
+	}
 
+	// Announce the change to listeners once the transaction commits
+	trailing := 0
+	if len(queued) > 0 {
+		payload, err := json.Marshal(models.SyncEvent{
+			UserID:    userID,
+			DeviceID:  deviceID,
+			Seq:       firstSeq + int64(queued[len(queued)-1]),
+			DataTypes: writtenDataTypes(writes, queued),
+		})
 		if err != nil {
 			return err
 		}
+		trailing++
+		batch.Queue(`SELECT pg_notify($1, $2)`, syncEventsChannel, string(payload))
 	}
 
-	// Log sync action
-	_, err := r.pool.Exec(ctx, `
-		INSERT INTO sync_log (id, user_id, device_id, action, data_type, items_count, created_at)
-		VALUES ($1, $2, $3, 'push', NULL, $4, $5)
-	`, uuid.New(), userID, deviceID, len(items), time.Now())
+	br := tx.SendBatch(ctx, batch)
+	for _, i := range queued {
+		// Archive + write
+		for n := 0; n < 2; n++ {
+			if _, err := br.Exec(); err != nil {
+				br.Close()
+				results[i].Status = models.SyncItemStatusFailed
+				results[i].Error = "failed to write item"
+				markSkipped(results)
+				return fmt.Errorf("write item %d: %w", i, err)
+			}
+		}
+		results[i].Seq = firstSeq + int64(i)
+	}
+	for n := 0; n < trailing; n++ {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			markSkipped(results)
+			return err
+		}
+	}
+	if err := br.Close(); err != nil {
+		markSkipped(results)
+		return err
+	}
+
+	// Log once the items are written, so the duration covers the writes
+	requestID := uuid.New()
+	if err := written.insert(ctx, tx, userID, deviceID, requestID, time.Now()); err != nil {
+		markSkipped(results)
+		return err
+	}
+	if len(conflicts.types) > 0 {
+		if err := conflicts.insert(ctx, tx, userID, deviceID, requestID, time.Now()); err != nil {
+			markSkipped(results)
+			return err
+		}
+	}
 
-	return err
+	return nil
 }
 
-func (r *SyncRepository) PullItems(ctx context.Context, userID uuid.UUID, since time.Time, dataType string) ([]models.SyncPullItem, error) {
-	var query string
-	var args []interface{}
+// loadCurrentItems returns the current server version of every written item
+// that carries a base revision, keyed by itemKey
+func loadCurrentItems(ctx context.Context, tx pgx.Tx, userID uuid.UUID, items []itemWrite) (map[string]models.SyncPullItem, error) {
+	var dataTypes, localIDs []string
+	for _, item := range items {
+		if item.BaseRevision != nil {
+			dataTypes = append(dataTypes, item.DataType)
+			localIDs = append(localIDs, item.LocalID)
+		}
+	}
+	current := make(map[string]models.SyncPullItem)
+	if len(dataTypes) == 0 {
+		return current, nil
+	}
 
-	if dataType != "" {
-		query = `
-			SELECT id, data_type, local_id, encrypted_blob, nonce, schema_version, updated_at, deleted_at
-			FROM encrypted_data
-			WHERE user_id = $1 AND updated_at > $2 AND data_type = $3
-			ORDER BY updated_at ASC
-		`
-		args = []interface{}{userID, since, dataType}
-	} else {
-		query = `
-			SELECT id, data_type, local_id, encrypted_blob, nonce, schema_version, updated_at, deleted_at
-			FROM encrypted_data
-			WHERE user_id = $1 AND updated_at > $2
-			ORDER BY updated_at ASC
-		`
-		args = []interface{}{userID, since}
+	rows, err := tx.Query(ctx, `
+		SELECT id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, seq, updated_at, deleted_at, attachments
+		FROM encrypted_data
+		WHERE user_id = $1 AND (data_type, local_id) IN (SELECT * FROM unnest($2::text[], $3::text[]))
+	`, userID, dataTypes, localIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	serverItems, err := scanPullItems(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range serverItems {
+		current[itemKey(item.DataType, item.LocalID)] = item
+	}
+	return current, nil
+}
+
+// writtenDataTypes returns the distinct data types of the queued writes
+func writtenDataTypes(writes []itemWrite, queued []int) []string {
+	seen := make(map[string]bool)
+	var dataTypes []string
+	for _, i := range queued {
+		if !seen[writes[i].DataType] {
+			seen[writes[i].DataType] = true
+			dataTypes = append(dataTypes, writes[i].DataType)
+		}
 	}
+	sort.Strings(dataTypes)
+	return dataTypes
+}
 
-	rows, err := r.pool.Query(ctx, query, args...)
+func itemKey(dataType, localID string) string {
+	return dataType + "/" + localID
+}
+
+// markSkipped flags every item that did not fail itself as skipped
+func markSkipped(results []models.SyncPushResult) {
+	for i := range results {
+		if results[i].Status == models.SyncItemStatusOK {
+			results[i].Status = models.SyncItemStatusSkipped
+		}
+		results[i].Seq = 0
+	}
+}
+
+// reserveSeqs allocates n change sequences for a user and returns the last one.
+// The sync_sequences row stays locked until the transaction ends.
+func reserveSeqs(ctx context.Context, tx pgx.Tx, userID uuid.UUID, n int) (int64, error) {
+	var lastSeq int64
+	err := tx.QueryRow(ctx, `
+		INSERT INTO sync_sequences (user_id, last_seq)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET last_seq = sync_sequences.last_seq + EXCLUDED.last_seq
+		RETURNING last_seq
+	`, userID, n).Scan(&lastSeq)
+	return lastSeq, err
+}
+
+// SeqSince translates a timestamp of the pre-cursor pull API into a seq to
+// pull after. Every item changed after since has a higher seq; items in
+// between that changed earlier are sent again, which clients tolerate.
+func (r *SyncRepository) SeqSince(ctx context.Context, userID uuid.UUID, since time.Time) (int64, error) {
+	var seq int64
+	err := r.pool.QueryRow(ctx, `
+		SELECT COALESCE(
+			(SELECT MIN(seq) - 1 FROM encrypted_data WHERE user_id = $1 AND updated_at > $2),
+			(SELECT last_seq FROM sync_sequences WHERE user_id = $1),
+			0)
+	`, userID, since).Scan(&seq)
+	return seq, err
+}
+
+// PullItems returns up to limit items changed after the given sequence, in
+// sequence order. hasMore reports whether further items are waiting.
+// ErrResyncRequired is returned if tombstones newer than afterSeq were purged.
+func (r *SyncRepository) PullItems(ctx context.Context, userID uuid.UUID, afterSeq int64, dataType string, limit int) (items []models.SyncPullItem, hasMore bool, err error) {
+	// Read the purge horizon and the items from the same snapshot
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if afterSeq > 0 {
+		var purgedSeq int64
+		err := tx.QueryRow(ctx, `SELECT purged_seq FROM sync_sequences WHERE user_id = $1`, userID).Scan(&purgedSeq)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, false, err
+		}
+		if afterSeq < purgedSeq {
+			return nil, false, ErrResyncRequired
+		}
+	}
+
+	query := `
+		SELECT id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, seq, updated_at, deleted_at, attachments
+		FROM encrypted_data
+		WHERE user_id = $1 AND seq > $2 AND ($3 = '' OR data_type = $3)
+		ORDER BY seq ASC
+		LIMIT $4
+	`
+	// Fetch one extra row to find out whether there is another page
+	rows, err := tx.Query(ctx, query, userID, afterSeq, dataType, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	items, err = scanPullItems(rows)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(items) > limit {
+		items = items[:limit]
+		hasMore = true
+	}
+	return items, hasMore, nil
+}
+
+// ListActiveItems returns all non-deleted items of a data type
+func (r *SyncRepository) ListActiveItems(ctx context.Context, userID uuid.UUID, dataType string) ([]models.SyncPullItem, error) {
+	rows, err := r.pool.Query(ctx, `
+		SELECT id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, seq, updated_at, deleted_at, attachments
+		FROM encrypted_data
+		WHERE user_id = $1 AND data_type = $2 AND deleted_at IS NULL
+		ORDER BY seq ASC
+	`, userID, dataType)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanPullItems(rows)
+}
+
+func scanPullItems(rows pgx.Rows) ([]models.SyncPullItem, error) {
 	var items []models.SyncPullItem
 	for rows.Next() {
 		var item models.SyncPullItem
 		var id uuid.UUID
-		var blob, nonce []byte
 		var updatedAt time.Time
 		var deletedAt *time.Time
 
-		err := rows.Scan(&id, &item.DataType, &item.LocalID, &blob, &nonce, &item.SchemaVersion, &updatedAt, &deletedAt)
+		err := rows.Scan(&id, &item.DataType, &item.LocalID, &item.EncryptedBlob, &item.Nonce, &item.SchemaVersion, &item.KeyGeneration, &item.Seq, &updatedAt, &deletedAt, &item.Attachments)
 		if err != nil {
 			return nil, err
 		}
 
 		item.ID = id.String()
-		item.EncryptedBlob = base64.StdEncoding.EncodeToString(blob)
-		item.Nonce = base64.StdEncoding.EncodeToString(nonce)
 		item.UpdatedAt = updatedAt.Unix()
 		item.Deleted = deletedAt != nil
 
@@ -117,11 +525,3 @@ func (r *SyncRepository) PullItems(ctx context.Context, userID uuid.UUID, since
 
 	return items, rows.Err()
 }
-
-func (r *SyncRepository) LogPull(ctx context.Context, userID, deviceID uuid.UUID, itemsCount int) error {
-	_, err := r.pool.Exec(ctx, `
-		INSERT INTO sync_log (id, user_id, device_id, action, data_type, items_count, created_at)
-		VALUES ($1, $2, $3, 'pull', NULL, $4, $5)
-	`, uuid.New(), userID, deviceID, itemsCount, time.Now())
-	return err
-}
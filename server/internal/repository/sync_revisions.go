@@ -0,0 +1,213 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// ListRevisions returns the archived versions of an item, newest first
+func (r *SyncRepository) ListRevisions(ctx context.Context, userID uuid.UUID, dataType, localID string) ([]models.SyncRevision, error) {
+	rows, err := r.pool.Query(ctx, `
+		SELECT id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, seq, deleted, valid_from, superseded_at, attachments
+		FROM encrypted_data_revisions
+		WHERE user_id = $1 AND data_type = $2 AND local_id = $3
+		ORDER BY valid_from DESC, seq DESC
+	`, userID, dataType, localID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []models.SyncRevision
+	for rows.Next() {
+		var rev models.SyncRevision
+		var id uuid.UUID
+		var blob, nonce []byte
+		var validFrom, supersededAt time.Time
+
+		err := rows.Scan(&id, &rev.DataType, &rev.LocalID, &blob, &nonce, &rev.SchemaVersion, &rev.KeyGeneration, &rev.Seq, &rev.Deleted, &validFrom, &supersededAt, &rev.Attachments)
+		if err != nil {
+			return nil, err
+		}
+
+		rev.ID = id.String()
+		rev.EncryptedBlob = base64.StdEncoding.EncodeToString(blob)
+		rev.Nonce = base64.StdEncoding.EncodeToString(nonce)
+		rev.ValidFrom = validFrom.Unix()
+		rev.SupersededAt = supersededAt.Unix()
+
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, rows.Err()
+}
+
+// RestoreRevision makes an archived version the current version of its item.
+// The restore is a regular write, so other devices pick it up on their next
+// pull, and is checked like a push. A version encrypted with an older key
+// cannot be restored (ErrStaleKeyGeneration). On errors of the checks the
+// item's result is returned as well.
+func (r *SyncRepository) RestoreRevision(ctx context.Context, userID, deviceID, revisionID uuid.UUID) (*models.SyncPushResult, error) {
+	started := time.Now()
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return nil, err
+	}
+
+	w := itemWrite{}
+	err = tx.QueryRow(ctx, `
+		SELECT data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, deleted, attachments
+		FROM encrypted_data_revisions
+		WHERE id = $1 AND user_id = $2
+	`, revisionID, userID).Scan(&w.DataType, &w.LocalID, &w.Blob, &w.Nonce, &w.SchemaVersion, &w.KeyGeneration, &w.Deleted, &w.Attachments)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	writes := []itemWrite{w}
+	results := newWriteResults(writes)
+	if err := r.checkWrites(writes, results); err != nil {
+		return &results[0], err
+	}
+	if err := r.applyGuarded(ctx, tx, userID, deviceID, "restore", started, writes, results); err != nil {
+		return &results[0], err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &results[0], nil
+}
+
+// RestoreToTime sets every item of a user back to the version it had at the
+// given time. Items created afterwards are soft-deleted. Items whose history
+// has already been cleaned up or whose old version is encrypted with an
+// outdated key are left untouched and counted as unavailable. The restore is
+// checked like a push.
+func (r *SyncRepository) RestoreToTime(ctx context.Context, userID, deviceID uuid.UUID, at time.Time) (*models.RestoreAccountResponse, error) {
+	started := time.Now()
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the user's sequence so no push interleaves with the restore
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return nil, err
+	}
+	keyGeneration, err := writeKeyGeneration(ctx, tx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// For every item changed after the restore point, find the version valid at that time
+	rows, err := tx.Query(ctx, `
+		SELECT e.data_type, e.local_id, e.created_at, e.deleted_at IS NOT NULL,
+		       r.encrypted_blob, r.nonce, r.schema_version, r.key_generation, r.deleted, r.attachments
+		FROM encrypted_data e
+		LEFT JOIN LATERAL (
+			SELECT encrypted_blob, nonce, schema_version, key_generation, deleted, attachments
+			FROM encrypted_data_revisions
+			WHERE user_id = e.user_id AND data_type = e.data_type AND local_id = e.local_id AND valid_from <= $2
+			ORDER BY valid_from DESC, seq DESC
+			LIMIT 1
+		) r ON true
+		WHERE e.user_id = $1 AND e.updated_at > $2
+	`, userID, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := &models.RestoreAccountResponse{}
+	var writes []itemWrite
+	for rows.Next() {
+		var w itemWrite
+		var createdAt time.Time
+		var currentlyDeleted bool
+		var revDeleted *bool
+		var revSchemaVersion, revKeyGeneration *int
+
+		err := rows.Scan(&w.DataType, &w.LocalID, &createdAt, &currentlyDeleted, &w.Blob, &w.Nonce, &revSchemaVersion, &revKeyGeneration, &revDeleted, &w.Attachments)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case revDeleted == nil && createdAt.After(at):
+			// Item did not exist yet
+			w.Deleted = true
+		case revDeleted == nil:
+			summary.Unavailable++
+			continue
+		default:
+			w.Deleted = *revDeleted
+			if revSchemaVersion != nil {
+				w.SchemaVersion = *revSchemaVersion
+			}
+			if revKeyGeneration != nil {
+				w.KeyGeneration = *revKeyGeneration
+			}
+			// Encrypted with a key the devices no longer have
+			if !w.Deleted && w.KeyGeneration != keyGeneration {
+				summary.Unavailable++
+				continue
+			}
+		}
+
+		if w.Deleted {
+			if currentlyDeleted {
+				continue
+			}
+			summary.Deleted++
+		} else {
+			summary.Restored++
+		}
+		writes = append(writes, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	results := newWriteResults(writes)
+	if err := r.checkWrites(writes, results); err != nil {
+		return nil, err
+	}
+	if err := r.applyGuarded(ctx, tx, userID, deviceID, "restore", started, writes, results); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// CleanupRevisions removes archived versions replaced before the cutoff.
+// Users in a key rotation keep theirs, an abort reverts to them.
+func (r *SyncRepository) CleanupRevisions(ctx context.Context, cutoff time.Time) error {
+	_, err := r.pool.Exec(ctx, `
+		DELETE FROM encrypted_data_revisions v
+		WHERE superseded_at < $1
+		  AND NOT EXISTS (SELECT 1 FROM key_rotations k WHERE k.user_id = v.user_id)
+	`, cutoff)
+	return err
+}
@@ -0,0 +1,321 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+var (
+	ErrRotationInProgress = errors.New("key rotation in progress")
+	ErrNoRotation         = errors.New("no key rotation in progress")
+	ErrRotationIncomplete = errors.New("items are still encrypted with the old key")
+	ErrNoKeyInfo          = errors.New("no encryption key set up")
+	ErrStaleKeyGeneration = errors.New("version is encrypted with an outdated key")
+	ErrAbortLosesItems    = errors.New("re-encrypted items have no version under the old key")
+)
+
+// keyRotationDataType is announced to other devices when a rotation starts or ends
+const keyRotationDataType = "key_rotation"
+
+// writeKeyGeneration returns the key generation the device's writes are
+// encrypted with. While a rotation runs, only the rotating device may write
+// and its writes belong to the new generation.
+func writeKeyGeneration(ctx context.Context, tx pgx.Tx, userID, deviceID uuid.UUID) (int, error) {
+	var current int
+	var rotatingDevice *uuid.UUID
+	var target *int
+	err := tx.QueryRow(ctx, `
+		SELECT u.key_generation, k.device_id, k.target_generation
+		FROM users u
+		LEFT JOIN key_rotations k ON k.user_id = u.id
+		WHERE u.id = $1
+	`, userID).Scan(&current, &rotatingDevice, &target)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if target == nil {
+		return current, nil
+	}
+	if rotatingDevice != nil && *rotatingDevice == deviceID {
+		return *target, nil
+	}
+	return 0, ErrRotationInProgress
+}
+
+// GetKeyRotation returns the key generation of a user and the progress of a
+// running rotation, if any
+func (r *SyncRepository) GetKeyRotation(ctx context.Context, userID uuid.UUID) (*models.KeyRotationStatus, error) {
+	return keyRotationStatus(ctx, r.pool, userID)
+}
+
+func keyRotationStatus(ctx context.Context, q rowQuerier, userID uuid.UUID) (*models.KeyRotationStatus, error) {
+	status := &models.KeyRotationStatus{}
+	var startedAt *time.Time
+	err := q.QueryRow(ctx, `
+		SELECT u.key_generation, k.device_id, k.target_generation, k.started_at
+		FROM users u
+		LEFT JOIN key_rotations k ON k.user_id = u.id
+		WHERE u.id = $1
+	`, userID).Scan(&status.KeyGeneration, &status.DeviceID, &status.TargetGeneration, &startedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status.TargetGeneration == nil {
+		return status, nil
+	}
+
+	status.InProgress = true
+	if startedAt != nil {
+		ts := startedAt.Unix()
+		status.StartedAt = &ts
+	}
+	err = q.QueryRow(ctx, `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE key_generation < $2)
+		FROM encrypted_data
+		WHERE user_id = $1 AND deleted_at IS NULL
+	`, userID, *status.TargetGeneration).Scan(&status.TotalItems, &status.RemainingItems)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// StartKeyRotation registers the new key info and makes deviceID the only
+// device allowed to push until the rotation is committed or aborted
+func (r *SyncRepository) StartKeyRotation(ctx context.Context, userID, deviceID uuid.UUID, newKeySalt, newKeyVerificationHash []byte) (*models.KeyRotationStatus, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the user's sequence so no push interleaves with the start
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return nil, err
+	}
+
+	var keySalt []byte
+	var keyGeneration int
+	err = tx.QueryRow(ctx, `
+		SELECT key_salt, key_generation FROM users WHERE id = $1
+	`, userID).Scan(&keySalt, &keyGeneration)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keySalt) == 0 {
+		return nil, ErrNoKeyInfo
+	}
+
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO key_rotations (user_id, device_id, new_key_salt, new_key_verification_hash, target_generation, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO NOTHING
+	`, userID, deviceID, newKeySalt, newKeyVerificationHash, keyGeneration+1, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrRotationInProgress
+	}
+
+	if err := notifyChange(ctx, tx, userID, deviceID, keyRotationDataType); err != nil {
+		return nil, err
+	}
+
+	status, err := keyRotationStatus(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return status, tx.Commit(ctx)
+}
+
+// lockKeyRotation locks the user's sequence and returns the running rotation
+func lockKeyRotation(ctx context.Context, tx pgx.Tx, userID uuid.UUID) (deviceID *uuid.UUID, targetGeneration int, err error) {
+	if _, err := reserveSeqs(ctx, tx, userID, 0); err != nil {
+		return nil, 0, err
+	}
+
+	err = tx.QueryRow(ctx, `
+		SELECT device_id, target_generation FROM key_rotations WHERE user_id = $1
+	`, userID).Scan(&deviceID, &targetGeneration)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, 0, ErrNoRotation
+	}
+	return deviceID, targetGeneration, err
+}
+
+// CommitKeyRotation swaps in the new key info once every live item is
+// encrypted with the new generation. Revisions under the old key can no
+// longer be decrypted and are removed.
+func (r *SyncRepository) CommitKeyRotation(ctx context.Context, userID, deviceID uuid.UUID) (*models.KeyRotationStatus, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rotatingDevice, target, err := lockKeyRotation(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if rotatingDevice == nil || *rotatingDevice != deviceID {
+		return nil, ErrRotationInProgress
+	}
+
+	status, err := keyRotationStatus(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if status.RemainingItems > 0 {
+		return status, ErrRotationIncomplete
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE users u
+		SET key_salt = k.new_key_salt, key_verification_hash = k.new_key_verification_hash,
+		    key_generation = k.target_generation, updated_at = $2
+		FROM key_rotations k
+		WHERE u.id = $1 AND k.user_id = u.id
+	`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM encrypted_data_revisions WHERE user_id = $1 AND key_generation < $2
+	`, userID, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM key_rotations WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	if err := notifyChange(ctx, tx, userID, deviceID, keyRotationDataType); err != nil {
+		return nil, err
+	}
+
+	status, err = keyRotationStatus(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return status, tx.Commit(ctx)
+}
+
+// AbortKeyRotation cancels a running rotation. Items already re-encrypted are
+// set back to their last version under the old key; items created during the
+// rotation are deleted. Returns the number of reverted items. If an item from
+// before the rotation has no version under the old key anymore, nothing is
+// changed and ErrAbortLosesItems is returned with the number of such items.
+func (r *SyncRepository) AbortKeyRotation(ctx context.Context, userID, deviceID uuid.UUID) (int, error) {
+	started := time.Now()
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, target, err := lockKeyRotation(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT e.data_type, e.local_id, e.deleted_at IS NOT NULL,
+		       e.created_at < (SELECT started_at FROM key_rotations WHERE user_id = e.user_id),
+		       r.encrypted_blob, r.nonce, r.schema_version, r.key_generation, r.deleted, r.attachments
+		FROM encrypted_data e
+		LEFT JOIN LATERAL (
+			SELECT encrypted_blob, nonce, schema_version, key_generation, deleted, attachments
+			FROM encrypted_data_revisions
+			WHERE user_id = e.user_id AND data_type = e.data_type AND local_id = e.local_id AND key_generation < $2
+			ORDER BY superseded_at DESC, seq DESC
+			LIMIT 1
+		) r ON true
+		WHERE e.user_id = $1 AND e.key_generation >= $2
+	`, userID, target)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var writes []itemWrite
+	lost := 0
+	for rows.Next() {
+		var w itemWrite
+		var currentlyDeleted, existedBefore bool
+		var revDeleted *bool
+		var revSchemaVersion, revKeyGeneration *int
+
+		err := rows.Scan(&w.DataType, &w.LocalID, &currentlyDeleted, &existedBefore, &w.Blob, &w.Nonce, &revSchemaVersion, &revKeyGeneration, &revDeleted, &w.Attachments)
+		if err != nil {
+			return 0, err
+		}
+
+		if revDeleted == nil {
+			if currentlyDeleted {
+				continue
+			}
+			if existedBefore {
+				// The old version is gone, deleting the item would lose it
+				lost++
+				continue
+			}
+			// Never existed under the old key
+			w.Deleted = true
+		} else {
+			w.Deleted = *revDeleted
+			w.SchemaVersion = *revSchemaVersion
+			w.KeyGeneration = *revKeyGeneration
+		}
+		writes = append(writes, w)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+	if lost > 0 {
+		return lost, ErrAbortLosesItems
+	}
+
+	results := newWriteResults(writes)
+	if err := r.applyWrites(ctx, tx, userID, deviceID, "rotation_abort", started, writes, results); err != nil {
+		return 0, err
+	}
+
+	// Versions under the abandoned key cannot be decrypted by anyone
+	_, err = tx.Exec(ctx, `
+		DELETE FROM encrypted_data_revisions WHERE user_id = $1 AND key_generation >= $2
+	`, userID, target)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM key_rotations WHERE user_id = $1`, userID); err != nil {
+		return 0, err
+	}
+
+	if err := notifyChange(ctx, tx, userID, deviceID, keyRotationDataType); err != nil {
+		return 0, err
+	}
+
+	return len(writes), tx.Commit(ctx)
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sprobst76/vibedtracker-server/internal/models"
+)
+
+// snapshotPageSize is how many items a snapshot reads per query. Every page
+// is a statement of its own, so no transaction stays open while a snapshot
+// is streamed to a slow client.
+const snapshotPageSize = 500
+
+// SnapshotSeq returns the change sequence a snapshot taken now corresponds
+// to. Sequences are reserved under a row lock and committed in order, so
+// every change up to it is visible.
+func (r *SyncRepository) SnapshotSeq(ctx context.Context, userID uuid.UUID) (int64, error) {
+	var seq int64
+	err := r.pool.QueryRow(ctx, `SELECT last_seq FROM sync_sequences WHERE user_id = $1`, userID).Scan(&seq)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// StreamSnapshot passes the live items with seq <= uptoSeq to onItem in
+// sequence order and logs the snapshot. Items changed after uptoSeq are left
+// out even if they existed before; pulling from uptoSeq delivers them.
+func (r *SyncRepository) StreamSnapshot(ctx context.Context, userID, deviceID uuid.UUID, dataType string, uptoSeq int64, started time.Time, onItem func(*models.SyncPullItem) error) error {
+	entry := newSyncLogEntry("snapshot", started)
+
+	var afterSeq int64
+	for {
+		rows, err := r.pool.Query(ctx, `
+			SELECT id, data_type, local_id, encrypted_blob, nonce, schema_version, key_generation, seq, updated_at, deleted_at, attachments
+			FROM encrypted_data
+			WHERE user_id = $1 AND seq > $2 AND seq <= $3 AND deleted_at IS NULL AND ($4 = '' OR data_type = $4)
+			ORDER BY seq ASC
+			LIMIT $5
+		`, userID, afterSeq, uptoSeq, dataType, snapshotPageSize)
+		if err != nil {
+			return err
+		}
+		items, err := scanPullItems(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for i := range items {
+			if err := onItem(&items[i]); err != nil {
+				return err
+			}
+			entry.add(items[i].DataType, false, len(items[i].EncryptedBlob)+len(items[i].Nonce))
+		}
+		if len(items) < snapshotPageSize {
+			break
+		}
+		afterSeq = items[len(items)-1].Seq
+	}
+
+	return entry.insert(ctx, r.pool, userID, deviceID, uuid.New(), time.Now())
+}
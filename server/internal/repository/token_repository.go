@@ -13,7 +13,10 @@ import (
 	"github.com/sprobst76/vibedtracker-server/internal/models"
 )
 
-var ErrTokenNotFound = errors.New("token not found")
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenReused   = errors.New("refresh token was already rotated")
+)
 
 type TokenRepository struct {
 	pool *pgxpool.Pool
@@ -28,33 +31,134 @@ func hashToken(token string) string {
 	return hex.EncodeToString(hash[:])
 }
 
-func (r *TokenRepository) Create(ctx context.Context, userID, deviceID uuid.UUID, token string, expiresAt time.Time) (*models.RefreshToken, error) {
+// Create stores the refresh token of a new login, which starts a token family
+func (r *TokenRepository) Create(ctx context.Context, userID, deviceID uuid.UUID, token string, expiresAt time.Time, client models.SessionClient) (*models.RefreshToken, error) {
+	id := uuid.New()
+	now := time.Now()
 	rt := &models.RefreshToken{
-		ID:        uuid.New(),
-		UserID:    userID,
-		DeviceID:  deviceID,
-		TokenHash: hashToken(token),
-		ExpiresAt: expiresAt,
-		Revoked:   false,
-		CreatedAt: time.Now(),
+		ID:               id,
+		UserID:           userID,
+		DeviceID:         deviceID,
+		FamilyID:         id,
+		TokenHash:        hashToken(token),
+		ExpiresAt:        expiresAt,
+		Revoked:          false,
+		SessionClient:    client,
+		SessionCreatedAt: now,
+		LastUsedAt:       now,
+		CreatedAt:        now,
 	}
 
-	_, err := r.pool.Exec(ctx, `
-		INSERT INTO refresh_tokens (id, user_id, device_id, token_hash, expires_at, revoked, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`, rt.ID, rt.UserID, rt.DeviceID, rt.TokenHash, rt.ExpiresAt, rt.Revoked, rt.CreatedAt)
-
+	err := insertToken(ctx, r.pool, rt)
 	return rt, err
 }
 
+func insertToken(ctx context.Context, q execer, rt *models.RefreshToken) error {
+	_, err := q.Exec(ctx, `
+		INSERT INTO refresh_tokens (id, user_id, device_id, family_id, token_hash, expires_at, revoked,
+		                            ip_address, user_agent, session_created_at, last_used_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, rt.ID, rt.UserID, rt.DeviceID, rt.FamilyID, rt.TokenHash, rt.ExpiresAt, rt.Revoked,
+		rt.IPAddress, rt.UserAgent, rt.SessionCreatedAt, rt.LastUsedAt, rt.CreatedAt)
+	return err
+}
+
+// Rotate exchanges a refresh token for its successor in the same family.
+// The old token is revoked but kept until it expires. Returns
+// ErrTokenReused if it has been rotated before, e.g. by a concurrent refresh.
+func (r *TokenRepository) Rotate(ctx context.Context, old *models.RefreshToken, token string, expiresAt time.Time, client models.SessionClient) (*models.RefreshToken, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	tag, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked = true, rotated_at = $1
+		WHERE id = $2 AND rotated_at IS NULL
+	`, now, old.ID)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrTokenReused
+	}
+
+	rt := &models.RefreshToken{
+		ID:               uuid.New(),
+		UserID:           old.UserID,
+		DeviceID:         old.DeviceID,
+		FamilyID:         old.FamilyID,
+		TokenHash:        hashToken(token),
+		ExpiresAt:        expiresAt,
+		Revoked:          false,
+		SessionClient:    client,
+		SessionCreatedAt: old.SessionCreatedAt,
+		LastUsedAt:       now,
+		CreatedAt:        now,
+	}
+	if err := insertToken(ctx, tx, rt); err != nil {
+		return nil, err
+	}
+
+	return rt, tx.Commit(ctx)
+}
+
+// RotateFamily rotates the live token of old's family instead of old
+// itself. It serves a refresh that raced the one which rotated old, so the
+// family keeps exactly one live token and the client gets a working one.
+// Returns ErrTokenNotFound if the family has no live token anymore, e.g.
+// after a logout.
+func (r *TokenRepository) RotateFamily(ctx context.Context, old *models.RefreshToken, token string, expiresAt time.Time, client models.SessionClient) (*models.RefreshToken, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	tag, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked = true, rotated_at = $1
+		WHERE family_id = $2 AND NOT revoked AND rotated_at IS NULL AND expires_at > $1
+	`, now, old.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrTokenNotFound
+	}
+
+	rt := &models.RefreshToken{
+		ID:               uuid.New(),
+		UserID:           old.UserID,
+		DeviceID:         old.DeviceID,
+		FamilyID:         old.FamilyID,
+		TokenHash:        hashToken(token),
+		ExpiresAt:        expiresAt,
+		Revoked:          false,
+		SessionClient:    client,
+		SessionCreatedAt: old.SessionCreatedAt,
+		LastUsedAt:       now,
+		CreatedAt:        now,
+	}
+	if err := insertToken(ctx, tx, rt); err != nil {
+		return nil, err
+	}
+
+	return rt, tx.Commit(ctx)
+}
+
 func (r *TokenRepository) GetByToken(ctx context.Context, token string) (*models.RefreshToken, error) {
 	hash := hashToken(token)
 	rt := &models.RefreshToken{}
 
 	err := r.pool.QueryRow(ctx, `
-		SELECT id, user_id, device_id, token_hash, expires_at, revoked, created_at
+		SELECT id, user_id, device_id, family_id, token_hash, expires_at, revoked, rotated_at,
+		       COALESCE(ip_address, ''), COALESCE(user_agent, ''), session_created_at, last_used_at, created_at
 		FROM refresh_tokens WHERE token_hash = $1
-	`, hash).Scan(&rt.ID, &rt.UserID, &rt.DeviceID, &rt.TokenHash, &rt.ExpiresAt, &rt.Revoked, &rt.CreatedAt)
+	`, hash).Scan(&rt.ID, &rt.UserID, &rt.DeviceID, &rt.FamilyID, &rt.TokenHash, &rt.ExpiresAt, &rt.Revoked, &rt.RotatedAt,
+		&rt.IPAddress, &rt.UserAgent, &rt.SessionCreatedAt, &rt.LastUsedAt, &rt.CreatedAt)
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, ErrTokenNotFound
@@ -62,11 +166,81 @@ func (r *TokenRepository) GetByToken(ctx context.Context, token string) (*models
 	return rt, err
 }
 
+// Touch records a use of a token that is not rotated on use (web sessions)
+func (r *TokenRepository) Touch(ctx context.Context, id uuid.UUID, client models.SessionClient) error {
+	_, err := r.pool.Exec(ctx, `
+		UPDATE refresh_tokens SET last_used_at = $1, ip_address = $2, user_agent = $3 WHERE id = $4
+	`, time.Now(), client.IPAddress, client.UserAgent, id)
+	return err
+}
+
+// ListSessions returns the live sessions of a user, most recently used first.
+// Only the newest token of a family is not revoked, so every live token is
+// one session.
+func (r *TokenRepository) ListSessions(ctx context.Context, userID uuid.UUID) ([]models.Session, error) {
+	rows, err := r.pool.Query(ctx, `
+		SELECT t.family_id, t.device_id, COALESCE(d.device_name, ''), COALESCE(d.device_type, ''),
+		       COALESCE(t.ip_address, ''), COALESCE(t.user_agent, ''), t.session_created_at, t.last_used_at, t.expires_at
+		FROM refresh_tokens t
+		LEFT JOIN devices d ON d.id = t.device_id
+		WHERE t.user_id = $1 AND NOT t.revoked AND t.expires_at > $2
+		ORDER BY t.last_used_at DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.DeviceID, &s.DeviceName, &s.DeviceType,
+			&s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends one session of a user
+func (r *TokenRepository) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	tag, err := r.pool.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND family_id = $2 AND NOT revoked
+	`, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions ends all sessions of a user except the given one and
+// returns how many were ended
+func (r *TokenRepository) RevokeOtherSessions(ctx context.Context, userID, keepSessionID uuid.UUID) (int64, error) {
+	tag, err := r.pool.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND family_id <> $2 AND NOT revoked
+	`, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
 func (r *TokenRepository) Revoke(ctx context.Context, id uuid.UUID) error {
 	_, err := r.pool.Exec(ctx, `UPDATE refresh_tokens SET revoked = true WHERE id = $1`, id)
 	return err
 }
 
+// RevokeFamily revokes every token rotated from the same login
+func (r *TokenRepository) RevokeFamily(ctx context.Context, familyID uuid.UUID) error {
+	_, err := r.pool.Exec(ctx, `UPDATE refresh_tokens SET revoked = true WHERE family_id = $1`, familyID)
+	return err
+}
+
 func (r *TokenRepository) RevokeByUserID(ctx context.Context, userID uuid.UUID) error {
 	_, err := r.pool.Exec(ctx, `UPDATE refresh_tokens SET revoked = true WHERE user_id = $1`, userID)
 	return err
@@ -77,7 +251,9 @@ func (r *TokenRepository) RevokeByDeviceID(ctx context.Context, deviceID uuid.UU
 	return err
 }
 
+// CleanupExpired deletes expired and revoked tokens. Rotated tokens stay
+// until they expire so that their reuse is still detected.
 func (r *TokenRepository) CleanupExpired(ctx context.Context) error {
-	_, err := r.pool.Exec(ctx, `DELETE FROM refresh_tokens WHERE expires_at < $1 OR revoked = true`, time.Now())
+	_, err := r.pool.Exec(ctx, `DELETE FROM refresh_tokens WHERE expires_at < $1 OR (revoked = true AND rotated_at IS NULL)`, time.Now())
 	return err
 }
@@ -54,11 +54,11 @@ func (r *UserRepository) Create(ctx context.Context, email, passwordHash string)
 func (r *UserRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
 	user := &models.User{}
 	err := r.pool.QueryRow(ctx, `
-		SELECT id, email, password_hash, is_approved, is_admin, is_blocked, key_salt, key_verification_hash,
+		SELECT id, email, password_hash, email_verified, is_approved, is_admin, is_blocked, key_salt, key_verification_hash,
 		       totp_secret, totp_enabled, totp_verified_at, created_at, updated_at
 		FROM users WHERE id = $1
 	`, id).Scan(
-		&user.ID, &user.Email, &user.PasswordHash, &user.IsApproved, &user.IsAdmin, &user.IsBlocked,
+		&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerified, &user.IsApproved, &user.IsAdmin, &user.IsBlocked,
 		&user.KeySalt, &user.KeyVerificationHash, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPVerifiedAt,
 		&user.CreatedAt, &user.UpdatedAt,
 	)
@@ -72,11 +72,11 @@ func (r *UserRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Use
 func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*models.User, error) {
 	user := &models.User{}
 	err := r.pool.QueryRow(ctx, `
-		SELECT id, email, password_hash, is_approved, is_admin, is_blocked, key_salt, key_verification_hash,
+		SELECT id, email, password_hash, email_verified, is_approved, is_admin, is_blocked, key_salt, key_verification_hash,
 		       totp_secret, totp_enabled, totp_verified_at, created_at, updated_at
 		FROM users WHERE email = $1
 	`, email).Scan(
-		&user.ID, &user.Email, &user.PasswordHash, &user.IsApproved, &user.IsAdmin, &user.IsBlocked,
+		&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerified, &user.IsApproved, &user.IsAdmin, &user.IsBlocked,
 		&user.KeySalt, &user.KeyVerificationHash, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPVerifiedAt,
 		&user.CreatedAt, &user.UpdatedAt,
 	)
@@ -89,7 +89,7 @@ func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*models.
 
 func (r *UserRepository) List(ctx context.Context) ([]models.User, error) {
 	rows, err := r.pool.Query(ctx, `
-		SELECT id, email, password_hash, is_approved, is_admin, is_blocked, key_salt, key_verification_hash,
+		SELECT id, email, password_hash, email_verified, is_approved, is_admin, is_blocked, key_salt, key_verification_hash,
 		       totp_secret, totp_enabled, totp_verified_at, created_at, updated_at
 		FROM users ORDER BY created_at DESC
 	`)
@@ -102,7 +102,7 @@ func (r *UserRepository) List(ctx context.Context) ([]models.User, error) {
 	for rows.Next() {
 		var user models.User
 		err := rows.Scan(
-			&user.ID, &user.Email, &user.PasswordHash, &user.IsApproved, &user.IsAdmin, &user.IsBlocked,
+			&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerified, &user.IsApproved, &user.IsAdmin, &user.IsBlocked,
 			&user.KeySalt, &user.KeyVerificationHash, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPVerifiedAt,
 			&user.CreatedAt, &user.UpdatedAt,
 		)
@@ -120,6 +120,18 @@ func (r *UserRepository) Approve(ctx context.Context, id uuid.UUID) error {
 	return err
 }
 
+// MarkEmailVerified sets the email address as verified without a token,
+// e.g. for the initial admin
+func (r *UserRepository) MarkEmailVerified(ctx context.Context, id uuid.UUID) error {
+	_, err := r.pool.Exec(ctx, `UPDATE users SET email_verified = true, updated_at = $1 WHERE id = $2`, time.Now(), id)
+	return err
+}
+
+func (r *UserRepository) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	_, err := r.pool.Exec(ctx, `UPDATE users SET password_hash = $1, updated_at = $2 WHERE id = $3`, passwordHash, time.Now(), id)
+	return err
+}
+
 func (r *UserRepository) Block(ctx context.Context, id uuid.UUID) error {
 	_, err := r.pool.Exec(ctx, `UPDATE users SET is_blocked = true, updated_at = $1 WHERE id = $2`, time.Now(), id)
 	return err
@@ -135,13 +147,32 @@ func (r *UserRepository) Delete(ctx context.Context, id uuid.UUID) error {
 	return err
 }
 
+// SetKeyInfo replaces the key info directly (first setup or recovery reset).
+// A new key starts a new key generation, so clients can tell which items were
+// encrypted with the old one. A running rotation is cancelled.
 func (r *UserRepository) SetKeyInfo(ctx context.Context, id uuid.UUID, keySalt, keyVerificationHash []byte) error {
 	_, err := r.pool.Exec(ctx, `
-		UPDATE users SET key_salt = $1, key_verification_hash = $2, updated_at = $3 WHERE id = $4
+		WITH cancelled AS (
+			DELETE FROM key_rotations WHERE user_id = $4 RETURNING target_generation
+		)
+		UPDATE users SET key_salt = $1, key_verification_hash = $2,
+			key_generation = CASE WHEN key_salt IS NULL OR key_salt = $1 THEN key_generation
+				ELSE GREATEST(key_generation, COALESCE((SELECT target_generation FROM cancelled), 0)) + 1 END,
+			updated_at = $3
+		WHERE id = $4
 	`, keySalt, keyVerificationHash, time.Now(), id)
 	return err
 }
 
+// HasSyncData reports whether the user has live encrypted items
+func (r *UserRepository) HasSyncData(ctx context.Context, id uuid.UUID) (bool, error) {
+	var exists bool
+	err := r.pool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM encrypted_data WHERE user_id = $1 AND deleted_at IS NULL)
+	`, id).Scan(&exists)
+	return exists, err
+}
+
 func (r *UserRepository) MakeAdmin(ctx context.Context, id uuid.UUID) error {
 	_, err := r.pool.Exec(ctx, `UPDATE users SET is_admin = true, is_approved = true, updated_at = $1 WHERE id = $2`, time.Now(), id)
 	return err
@@ -180,7 +211,76 @@ func (r *UserRepository) GetStats(ctx context.Context) (*models.AdminStatsRespon
 		return nil, err
 	}
 
-	return stats, nil
+	rows, err := r.pool.Query(ctx, `
+		SELECT u.id, u.email, u.quota_bytes, u.quota_items,
+		       COALESCE(SUM(octet_length(e.encrypted_blob) + octet_length(e.nonce)), 0)
+		         + (SELECT COALESCE(SUM(a.size), 0)::bigint FROM attachments a WHERE a.user_id = u.id) AS used_bytes,
+		       COUNT(e.id)
+		FROM users u
+		LEFT JOIN encrypted_data e ON e.user_id = u.id AND e.deleted_at IS NULL
+		GROUP BY u.id
+		ORDER BY used_bytes DESC, u.email
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats.StorageByUser = []models.UserStorageStats{}
+	for rows.Next() {
+		var s models.UserStorageStats
+		if err := rows.Scan(&s.UserID, &s.Email, &s.QuotaBytes, &s.QuotaItems, &s.UsedBytes, &s.UsedItems); err != nil {
+			return nil, err
+		}
+		stats.TotalStorageBytes += s.UsedBytes
+		stats.StorageByUser = append(stats.StorageByUser, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// What the devices actually sync, per data type
+	rows, err = r.pool.Query(ctx, `
+		SELECT data_type,
+		       COALESCE(SUM(upserts) FILTER (WHERE action NOT IN ('pull', 'snapshot')), 0),
+		       COALESCE(SUM(deletes) FILTER (WHERE action NOT IN ('pull', 'snapshot')), 0),
+		       COALESCE(SUM(bytes) FILTER (WHERE action NOT IN ('pull', 'snapshot')), 0)::bigint,
+		       COALESCE(SUM(items_count) FILTER (WHERE action IN ('pull', 'snapshot')), 0),
+		       COALESCE(SUM(bytes) FILTER (WHERE action IN ('pull', 'snapshot')), 0)::bigint
+		FROM sync_log
+		WHERE created_at >= $1 AND data_type IS NOT NULL AND action NOT IN ('conflict', 'purge')
+		GROUP BY data_type
+		ORDER BY data_type
+	`, time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats.SyncByDataType = []models.DataTypeSyncStats{}
+	for rows.Next() {
+		var s models.DataTypeSyncStats
+		if err := rows.Scan(&s.DataType, &s.Upserts, &s.Deletes, &s.WrittenBytes, &s.PulledItems, &s.PulledBytes); err != nil {
+			return nil, err
+		}
+		stats.SyncByDataType = append(stats.SyncByDataType, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// SetQuota overrides the storage quota of a user; nil restores the default
+func (r *UserRepository) SetQuota(ctx context.Context, id uuid.UUID, quotaBytes *int64, quotaItems *int) error {
+	tag, err := r.pool.Exec(ctx, `
+		UPDATE users SET quota_bytes = $1, quota_items = $2, updated_at = $3 WHERE id = $4
+	`, quotaBytes, quotaItems, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
 }
 
 // TOTP methods
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrInvalidBlobKey = errors.New("invalid blob key")
+)
+
+// BlobStore keeps the encrypted attachment files. Keys are relative,
+// slash-separated paths chosen by the caller. The local filesystem backend
+// is the default; S3-compatible backends can implement the same interface,
+// mapping Append to multipart uploads.
+type BlobStore interface {
+	// Append writes r at offset, discarding anything stored after it, and
+	// returns the number of bytes written. Appending at 0 creates the blob.
+	Append(ctx context.Context, key string, offset int64, r io.Reader) (int64, error)
+
+	// Open returns the blob for (ranged) reading together with its size
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, int64, error)
+
+	// Move renames a blob, replacing an existing blob at the target
+	Move(ctx context.Context, from, to string) error
+
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+}
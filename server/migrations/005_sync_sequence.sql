@@ -0,0 +1,34 @@
+-- VibedTracker Database Schema
+-- Migration: 005_sync_sequence
+-- Date: 2026-10-16
+-- Description: Per-user monotonic change sequence for cursor-based sync pulls
+
+-- Last assigned change sequence per user
+-- The row is locked for the duration of a push, so sequences become visible in order
+CREATE TABLE sync_sequences (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    last_seq BIGINT NOT NULL DEFAULT 0
+);
+
+ALTER TABLE encrypted_data ADD COLUMN seq BIGINT;
+
+-- Backfill existing rows in update order (without touching updated_at)
+ALTER TABLE encrypted_data DISABLE TRIGGER update_encrypted_data_updated_at;
+
+UPDATE encrypted_data e
+SET seq = ordered.rn
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY updated_at, id) AS rn
+    FROM encrypted_data
+) ordered
+WHERE e.id = ordered.id;
+
+ALTER TABLE encrypted_data ENABLE TRIGGER update_encrypted_data_updated_at;
+
+INSERT INTO sync_sequences (user_id, last_seq)
+SELECT user_id, MAX(seq) FROM encrypted_data WHERE user_id IS NOT NULL GROUP BY user_id;
+
+ALTER TABLE encrypted_data ALTER COLUMN seq SET NOT NULL;
+
+-- Index for cursor-based pulls
+CREATE UNIQUE INDEX idx_encrypted_data_user_seq ON encrypted_data(user_id, seq);
@@ -0,0 +1,27 @@
+-- VibedTracker Database Schema
+-- Migration: 006_revisions
+-- Date: 2026-10-16
+-- Description: Keep previous versions of encrypted items for restore
+
+-- Archived versions of encrypted_data rows (still Zero-Knowledge)
+-- A row is written whenever a sync write replaces the current version
+CREATE TABLE encrypted_data_revisions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID REFERENCES devices(id) ON DELETE SET NULL,  -- Gerät, das diese Version geschrieben hat
+    data_type VARCHAR(50) NOT NULL,
+    local_id VARCHAR(255),
+    encrypted_blob BYTEA NOT NULL,
+    nonce BYTEA NOT NULL,
+    schema_version INT DEFAULT 1,
+    seq BIGINT NOT NULL,                    -- Revision (seq) der archivierten Version
+    deleted BOOLEAN DEFAULT FALSE,          -- Version war ein Soft-Delete
+    valid_from TIMESTAMPTZ NOT NULL,        -- updated_at der archivierten Version
+    superseded_at TIMESTAMPTZ DEFAULT NOW() -- Zeitpunkt, an dem sie ersetzt wurde
+);
+
+-- Index for listing revisions of an item and point-in-time lookups
+CREATE INDEX idx_revisions_item ON encrypted_data_revisions(user_id, data_type, local_id, valid_from DESC);
+
+-- Index for retention cleanup
+CREATE INDEX idx_revisions_superseded ON encrypted_data_revisions(superseded_at);
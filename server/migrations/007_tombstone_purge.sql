@@ -0,0 +1,8 @@
+-- VibedTracker Database Schema
+-- Migration: 007_tombstone_purge
+-- Date: 2026-10-16
+-- Description: Track the purge horizon of soft-deleted sync items
+
+-- Highest seq of a tombstone that was purged for good
+-- Devices whose cursor is older must do a full resync
+ALTER TABLE sync_sequences ADD COLUMN purged_seq BIGINT NOT NULL DEFAULT 0;
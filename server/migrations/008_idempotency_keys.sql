@@ -0,0 +1,18 @@
+-- VibedTracker Database Schema
+-- Migration: 008_idempotency_keys
+-- Date: 2026-10-16
+-- Description: Remember push responses per Idempotency-Key so retries are replayed
+
+-- A row is claimed before the push runs (status_code NULL) and completed
+-- with the response afterwards. Retries with the same key get the stored response.
+CREATE TABLE idempotency_keys (
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL,     -- SHA-256 des Request-Bodys
+    status_code INT,                       -- NULL solange der Request läuft
+    response BYTEA,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, idempotency_key)
+);
+
+CREATE INDEX idx_idempotency_keys_created ON idempotency_keys(created_at);
@@ -0,0 +1,8 @@
+-- VibedTracker Database Schema
+-- Migration: 009_storage_quotas
+-- Date: 2026-10-16
+-- Description: Per-user storage quota overrides for encrypted_data
+
+-- NULL = Server-Default (USER_QUOTA_BYTES / USER_QUOTA_ITEMS), 0 = unbegrenzt
+ALTER TABLE users ADD COLUMN quota_bytes BIGINT;
+ALTER TABLE users ADD COLUMN quota_items INT;
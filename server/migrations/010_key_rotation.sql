@@ -0,0 +1,23 @@
+-- VibedTracker Database Schema
+-- Migration: 010_key_rotation
+-- Date: 2026-10-16
+-- Description: Key generations and server-coordinated passphrase rotation
+
+-- Generation of the encryption key; increases whenever the key info changes
+ALTER TABLE users ADD COLUMN key_generation INT NOT NULL DEFAULT 1;
+
+-- Key generation each item is encrypted with
+ALTER TABLE encrypted_data ADD COLUMN key_generation INT NOT NULL DEFAULT 1;
+
+ALTER TABLE encrypted_data_revisions ADD COLUMN key_generation INT NOT NULL DEFAULT 1;
+
+-- Running key rotation (max. one per user)
+-- One device re-encrypts all items with the new key; other devices pause pushing
+CREATE TABLE key_rotations (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID REFERENCES devices(id) ON DELETE CASCADE,  -- Gerät, das neu verschlüsselt
+    new_key_salt BYTEA NOT NULL,
+    new_key_verification_hash BYTEA NOT NULL,
+    target_generation INT NOT NULL,
+    started_at TIMESTAMPTZ DEFAULT NOW()
+);
@@ -0,0 +1,7 @@
+-- VibedTracker Database Schema
+-- Migration: 011_schema_versions
+-- Date: 2026-10-16
+-- Description: Schema versions each device can decode, per data_type
+
+-- z.B. {"work_entry": 2, "vacation": 1}; fehlende data_types = keine Einschränkung
+ALTER TABLE devices ADD COLUMN schema_versions JSONB NOT NULL DEFAULT '{}';
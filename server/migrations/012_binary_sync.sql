@@ -0,0 +1,8 @@
+-- VibedTracker Database Schema
+-- Migration: 012_binary_sync
+-- Date: 2026-10-16
+-- Description: Store the content type of idempotent responses (JSON or CBOR)
+
+-- Replays must answer in the encoding of the original response
+ALTER TABLE idempotency_keys
+    ADD COLUMN content_type VARCHAR(100) NOT NULL DEFAULT 'application/json; charset=utf-8';
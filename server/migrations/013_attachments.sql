@@ -0,0 +1,39 @@
+-- VibedTracker Database Schema
+-- Migration: 013_attachments
+-- Date: 2026-10-16
+-- Description: Encrypted attachments (Belege, Stundenzettel) outside encrypted_data
+
+-- Attachments referenced by an item (SHA-256 of the encrypted file)
+ALTER TABLE encrypted_data ADD COLUMN attachments TEXT[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE encrypted_data_revisions ADD COLUMN attachments TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_encrypted_data_attachments ON encrypted_data USING GIN (attachments);
+CREATE INDEX idx_encrypted_data_revisions_attachments ON encrypted_data_revisions USING GIN (attachments);
+
+-- Stored attachments, content-addressed per user. The file itself lives in the blob store.
+-- No foreign key on users: rows of deleted users become unreferenced and are
+-- removed together with their files by the periodic cleanup.
+CREATE TABLE attachments (
+    user_id UUID NOT NULL,
+    hash VARCHAR(64) NOT NULL,             -- SHA-256 (hex) des verschlüsselten Inhalts
+    size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, hash)
+);
+
+CREATE INDEX idx_attachments_created ON attachments(created_at);
+
+-- Unfinished chunked uploads; offset = bytes received so far
+CREATE TABLE attachment_uploads (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    hash VARCHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    received BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX idx_attachment_uploads_user ON attachment_uploads(user_id);
+CREATE INDEX idx_attachment_uploads_updated ON attachment_uploads(updated_at);
@@ -0,0 +1,14 @@
+-- VibedTracker Database Schema
+-- Migration: 014_device_cursors
+-- Date: 2026-10-16
+-- Description: Remember the last acknowledged pull cursor of each device per data type
+
+-- A device acknowledges everything before the cursor it sends with a pull.
+-- data_type '*' stands for pulls over all data types.
+CREATE TABLE device_cursors (
+    device_id UUID REFERENCES devices(id) ON DELETE CASCADE,
+    data_type VARCHAR(50) NOT NULL,
+    seq BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (device_id, data_type)
+);
@@ -0,0 +1,14 @@
+-- VibedTracker Database Schema
+-- Migration: 015_sync_log_breakdown
+-- Date: 2026-10-16
+-- Description: Record sync activity per data type with upserts, deletes, volume and duration
+
+-- A push or pull now writes one row per data type; rows of the same request
+-- share request_id. items_count stays upserts + deletes.
+ALTER TABLE sync_log ADD COLUMN request_id UUID;
+ALTER TABLE sync_log ADD COLUMN upserts INT NOT NULL DEFAULT 0;
+ALTER TABLE sync_log ADD COLUMN deletes INT NOT NULL DEFAULT 0;
+ALTER TABLE sync_log ADD COLUMN bytes BIGINT NOT NULL DEFAULT 0;      -- Blob + Nonce der übertragenen Einträge
+ALTER TABLE sync_log ADD COLUMN duration_ms INT;                      -- Verarbeitungszeit auf dem Server
+
+CREATE INDEX idx_sync_log_created ON sync_log(created_at);
@@ -0,0 +1,48 @@
+-- VibedTracker Database Schema
+-- Migration: 016_merge_web_devices
+-- Date: 2026-10-16
+-- Description: Merge the duplicate "Web Browser" devices created per web request into one device per user
+
+-- Only content changes bump updated_at, so moving items to another device
+-- leaves their timestamps alone. Sync writes set updated_at themselves.
+DROP TRIGGER update_encrypted_data_updated_at ON encrypted_data;
+
+CREATE TRIGGER update_encrypted_data_updated_at
+    BEFORE UPDATE OF encrypted_blob, nonce, deleted_at ON encrypted_data
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+-- The oldest web device of each user is kept
+CREATE TEMP TABLE web_device_merge AS
+SELECT id, keep_id FROM (
+    SELECT id, FIRST_VALUE(id) OVER (PARTITION BY user_id ORDER BY created_at, id) AS keep_id
+    FROM devices
+    WHERE device_type = 'web' AND device_name = 'Web Browser'
+) d
+WHERE id <> keep_id;
+
+UPDATE encrypted_data t SET device_id = m.keep_id FROM web_device_merge m WHERE t.device_id = m.id;
+UPDATE encrypted_data_revisions t SET device_id = m.keep_id FROM web_device_merge m WHERE t.device_id = m.id;
+UPDATE sync_log t SET device_id = m.keep_id FROM web_device_merge m WHERE t.device_id = m.id;
+UPDATE refresh_tokens t SET device_id = m.keep_id FROM web_device_merge m WHERE t.device_id = m.id;
+UPDATE active_sessions t SET device_id = m.keep_id FROM web_device_merge m WHERE t.device_id = m.id;
+UPDATE key_rotations t SET device_id = m.keep_id FROM web_device_merge m WHERE t.device_id = m.id;
+
+INSERT INTO device_cursors (device_id, data_type, seq, updated_at)
+SELECT m.keep_id, c.data_type, MAX(c.seq), MAX(c.updated_at)
+FROM device_cursors c JOIN web_device_merge m ON m.id = c.device_id
+GROUP BY m.keep_id, c.data_type
+ON CONFLICT (device_id, data_type) DO UPDATE
+SET seq = GREATEST(device_cursors.seq, EXCLUDED.seq), updated_at = GREATEST(device_cursors.updated_at, EXCLUDED.updated_at);
+
+UPDATE devices d SET last_sync = GREATEST(d.last_sync, s.last_sync)
+FROM (
+    SELECT m.keep_id, MAX(dup.last_sync) AS last_sync
+    FROM web_device_merge m JOIN devices dup ON dup.id = m.id
+    GROUP BY m.keep_id
+) s
+WHERE d.id = s.keep_id AND s.last_sync IS NOT NULL;
+
+DELETE FROM devices d USING web_device_merge m WHERE d.id = m.id;
+
+DROP TABLE web_device_merge;
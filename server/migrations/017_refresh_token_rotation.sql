@@ -0,0 +1,18 @@
+-- VibedTracker Database Schema
+-- Migration: 017_refresh_token_rotation
+-- Date: 2026-10-16
+-- Description: Rotate refresh tokens on every refresh and detect reuse of rotated tokens
+
+-- All tokens issued from one login form a family; a login starts a new one
+ALTER TABLE refresh_tokens ADD COLUMN family_id UUID;
+UPDATE refresh_tokens SET family_id = id;
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+
+-- Set when the token was exchanged for its successor. Rotated tokens are kept
+-- until they expire, so presenting one again can be recognized as reuse.
+ALTER TABLE refresh_tokens ADD COLUMN rotated_at TIMESTAMPTZ;
+
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens(family_id);
+
+-- Set when a rotated refresh token of the device was presented again
+ALTER TABLE devices ADD COLUMN token_reuse_at TIMESTAMPTZ;
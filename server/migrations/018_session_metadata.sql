@@ -0,0 +1,17 @@
+-- VibedTracker Database Schema
+-- Migration: 018_session_metadata
+-- Date: 2026-10-16
+-- Description: Record where and when sessions are used so users can review and revoke them
+
+-- A session is a token family; its live token carries the metadata of the last use
+ALTER TABLE refresh_tokens ADD COLUMN ip_address VARCHAR(45);
+ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT;
+ALTER TABLE refresh_tokens ADD COLUMN session_created_at TIMESTAMPTZ;  -- Login of the family
+ALTER TABLE refresh_tokens ADD COLUMN last_used_at TIMESTAMPTZ;
+
+UPDATE refresh_tokens SET session_created_at = created_at, last_used_at = created_at;
+
+ALTER TABLE refresh_tokens ALTER COLUMN session_created_at SET NOT NULL;
+ALTER TABLE refresh_tokens ALTER COLUMN last_used_at SET NOT NULL;
+
+CREATE INDEX idx_refresh_tokens_user_live ON refresh_tokens(user_id) WHERE NOT revoked;
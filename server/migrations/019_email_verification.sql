@@ -0,0 +1,13 @@
+-- VibedTracker Database Schema
+-- Migration: 019_email_verification
+-- Date: 2026-10-16
+-- Description: Verify email addresses on registration
+
+-- Accounts approved so far were vetted by an admin
+UPDATE users SET email_verified = true WHERE is_approved;
+UPDATE users SET email_verified = false WHERE email_verified IS NULL;
+ALTER TABLE users ALTER COLUMN email_verified SET NOT NULL;
+
+-- email_verifications.token holds the SHA-256 hash of the token sent by mail.
+-- Every sent mail is a row, which the resend rate limit counts.
+CREATE INDEX idx_email_verifications_user ON email_verifications(user_id, created_at);
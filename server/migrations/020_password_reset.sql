@@ -0,0 +1,10 @@
+-- VibedTracker Database Schema
+-- Migration: 020_password_reset
+-- Date: 2026-10-16
+-- Description: Reset forgotten account passwords by mail
+
+-- password_resets.token holds the SHA-256 hash of the token sent by mail.
+-- Every sent mail is a row, which the request rate limit counts.
+UPDATE password_resets SET used = false WHERE used IS NULL;
+ALTER TABLE password_resets ALTER COLUMN used SET NOT NULL;
+CREATE INDEX idx_password_resets_user ON password_resets(user_id, created_at);
@@ -0,0 +1,42 @@
+/**
+ * VibedTracker Live Sync Events
+ * Listens for changes made on other devices (Server-Sent Events)
+ */
+
+const VTSyncEvents = {
+    source: null,
+    handlers: {},
+
+    /**
+     * Register a callback for changes of a data type
+     * @param {string} dataType - e.g. 'work_entry' or 'vacation'
+     * @param {Function} callback - Called with the event data
+     */
+    on(dataType, callback) {
+        (this.handlers[dataType] = this.handlers[dataType] || []).push(callback);
+        this.connect();
+    },
+
+    /**
+     * Open the event stream (the browser reconnects automatically)
+     */
+    connect() {
+        if (this.source || typeof EventSource === 'undefined') return;
+
+        this.source = new EventSource('/web/api/events', { withCredentials: true });
+        this.source.addEventListener('changed', (e) => {
+            let data;
+            try {
+                data = JSON.parse(e.data);
+            } catch (err) {
+                return;
+            }
+
+            for (const dataType of data.data_types || []) {
+                for (const callback of this.handlers[dataType] || []) {
+                    callback(data);
+                }
+            }
+        });
+    }
+};
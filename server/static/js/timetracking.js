@@ -642,6 +642,17 @@ document.addEventListener('DOMContentLoaded', async () => {
                 if (entriesContainer) {
                     TimeTrackingManager.renderEntriesList('entries-list');
                 }
+
+                // Reload when entries change on another device
+                if (typeof VTSyncEvents !== 'undefined') {
+                    VTSyncEvents.on('work_entry', async () => {
+                        await TimeTrackingManager.loadEntries();
+                        TimeTrackingManager.updateDashboardStats();
+                        if (entriesContainer) {
+                            TimeTrackingManager.renderEntriesList('entries-list');
+                        }
+                    });
+                }
             }
         }
     }
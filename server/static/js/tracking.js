@@ -32,6 +32,18 @@ const TrackingManager = {
         await this.checkActiveEntry();
         this.updateUI();
 
+        // Pick up timers started or stopped on another device
+        if (typeof VTSyncEvents !== 'undefined') {
+            const refresh = async () => {
+                this.currentEntry = null;
+                this.isPaused = false;
+                await this.checkActiveEntry();
+                this.updateUI();
+            };
+            VTSyncEvents.on('work_entry', refresh);
+            VTSyncEvents.on('active_session', refresh);
+        }
+
         return true;
     },
 
@@ -42,6 +54,9 @@ const TrackingManager = {
         if (!this.key) return;
 
         try {
+            // Timer running on any device (phone or web)
+            const activeLocalId = await this.getActiveTimerLocalId();
+
             const response = await fetch('/web/api/data?type=work_entry', {
                 credentials: 'same-origin'
             });
@@ -50,8 +65,14 @@ const TrackingManager = {
 
             const data = await response.json();
 
+            // Prefer the entry of the running timer, otherwise look for one without stop time
+            const items = data.items || [];
+            if (activeLocalId) {
+                items.sort((a, b) => (b.local_id === activeLocalId) - (a.local_id === activeLocalId));
+            }
+
             // Find entry without stop time (active entry)
-            for (const item of data.items || []) {
+            for (const item of items) {
                 try {
                     const decrypted = await VTCrypto.decrypt(
                         this.key,
@@ -87,6 +108,75 @@ const TrackingManager = {
         }
     },
 
+    /**
+     * Get the local ID of the work entry whose timer is running, if any
+     */
+    async getActiveTimerLocalId() {
+        try {
+            const response = await fetch('/web/api/timer', {
+                credentials: 'same-origin'
+            });
+            if (!response.ok) return null;
+
+            const data = await response.json();
+            return data.active_session ? data.active_session.work_entry_local_id : null;
+        } catch (error) {
+            console.error('Error loading timer:', error);
+            return null;
+        }
+    },
+
+    /**
+     * Register the running timer on the server so other devices see it
+     * @returns {boolean} - false if the user declined to take over another device's timer
+     */
+    async startServerTimer(localId, startedAt, force = false) {
+        const response = await fetch('/web/api/timer/start', {
+            method: 'POST',
+            credentials: 'same-origin',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                work_entry_local_id: localId,
+                started_at: Math.floor(startedAt.getTime() / 1000),
+                force: force
+            })
+        });
+
+        if (response.status === 409) {
+            if (!confirm('Auf einem anderen Gerät läuft bereits ein Timer. Trotzdem hier starten?')) {
+                return false;
+            }
+            return this.startServerTimer(localId, startedAt, true);
+        }
+
+        if (!response.ok) {
+            console.error('Failed to start timer on server');
+        }
+        return true;
+    },
+
+    /**
+     * Remove the running timer from the server
+     */
+    async stopServerTimer(localId) {
+        const response = await fetch('/web/api/timer/stop', {
+            method: 'POST',
+            credentials: 'same-origin',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                work_entry_local_id: localId
+            })
+        });
+
+        if (!response.ok && response.status !== 404) {
+            console.error('Failed to stop timer on server');
+        }
+    },
+
     /**
      * Start tracking
      */
@@ -105,6 +195,10 @@ const TrackingManager = {
         const now = new Date();
         const localId = Date.now().toString();
 
+        if (!await this.startServerTimer(localId, now)) {
+            return;
+        }
+
         this.currentEntry = {
             key: parseInt(localId),
             localId: localId,
@@ -139,6 +233,7 @@ const TrackingManager = {
 
         this.currentEntry.stop = new Date().toISOString();
         await this.saveCurrentEntry();
+        await this.stopServerTimer(this.currentEntry.localId);
 
         this.currentEntry = null;
         this.isPaused = false;
@@ -579,6 +579,16 @@ const VacationManager = {
 // Auto-initialize on DOMContentLoaded
 document.addEventListener('DOMContentLoaded', () => {
     if (document.getElementById('calendar-grid')) {
-        VacationManager.init();
+        VacationManager.init().then((success) => {
+            // Reload when absences change on another device
+            if (success && typeof VTSyncEvents !== 'undefined') {
+                VTSyncEvents.on('vacation', async () => {
+                    await VacationManager.loadAbsences();
+                    VacationManager.renderCalendar();
+                    VacationManager.updateStats();
+                    VacationManager.renderAbsencesList();
+                });
+            }
+        });
     }
 });